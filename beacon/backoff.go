@@ -0,0 +1,45 @@
+package beacon
+
+import "math"
+import "time"
+import "math/rand"
+
+// Backoff calculates exponentially increasing, jittered delays between retry attempts.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Jitter  float64
+}
+
+// Delay returns the amount of time to wait before the given (zero-based) attempt. The delay doubles each attempt
+// until it reaches the max (or the longest duration, without one), after which a random portion (determined by the
+// jitter fraction) is subtracted from it.
+func (backoff *Backoff) Delay(attempt uint) time.Duration {
+	delay := backoff.Initial
+
+	for i := uint(0); i < attempt && (backoff.Max <= 0 || delay < backoff.Max); i++ {
+		// Without a max the delay would eventually overflow; it stops growing at the longest duration instead.
+		if delay > math.MaxInt64/2 {
+			delay = math.MaxInt64
+			break
+		}
+
+		delay *= 2
+	}
+
+	if backoff.Max > 0 && delay > backoff.Max {
+		delay = backoff.Max
+	}
+
+	if backoff.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+
+	jitter := backoff.Jitter
+
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	return delay - time.Duration(rand.Float64()*jitter*float64(delay))
+}
@@ -0,0 +1,41 @@
+package beacon
+
+import "math"
+import "time"
+import "testing"
+
+func TestBackoffDelay(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		backoff  Backoff
+		attempt  uint
+		expected time.Duration
+	}{
+		{"first attempt", Backoff{Initial: time.Second}, 0, time.Second},
+		{"doubles each attempt", Backoff{Initial: time.Second}, 3, 8 * time.Second},
+		{"capped at the max", Backoff{Initial: time.Second, Max: 5 * time.Second}, 3, 5 * time.Second},
+		{"capped far past the max", Backoff{Initial: time.Second, Max: 5 * time.Second}, 1000, 5 * time.Second},
+		{"uncapped before overflowing", Backoff{Initial: time.Second}, 33, time.Second << 33},
+		{"uncapped once doubling would overflow", Backoff{Initial: time.Second}, 34, math.MaxInt64},
+		{"uncapped past the width of a duration", Backoff{Initial: time.Second}, 64, math.MaxInt64},
+		{"uncapped after many attempts", Backoff{Initial: time.Second}, math.MaxUint32, math.MaxInt64},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			if delay := scenario.backoff.Delay(scenario.attempt); delay != scenario.expected {
+				t.Fatalf("expected attempt %d to wait %s, got %s", scenario.attempt, scenario.expected, delay)
+			}
+		})
+	}
+}
+
+func TestBackoffDelayWithJitterStaysPositive(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Jitter: 0.5}
+
+	for attempt := uint(0); attempt < 200; attempt++ {
+		if delay := backoff.Delay(attempt); delay <= 0 {
+			t.Fatalf("expected attempt %d to wait, got %s", attempt, delay)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package beacon
+
+import "fmt"
+import "sync"
+import "time"
+import "bytes"
+import "context"
+import "net/url"
+import "crypto"
+import "github.com/hink/go-blink1"
+import "github.com/golang/protobuf/proto"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
+import "github.com/dadleyy/beacon.client/beacon/interchange"
+
+// ClientConfig holds everything a client needs in order to connect a device to the api. The subscriber, device and
+// keys are interfaces so that programs embedding the client can provide their own implementations.
+type ClientConfig struct {
+	// APIHome is the address of the api; feedback is published to it.
+	APIHome url.URL
+
+	// DeviceName is pre-registered with the api before every connection attempt when not empty.
+	DeviceName string
+
+	Subscriber Subscriber
+	Device     Commandable
+	Decrypter  Decrypter
+	Signer     crypto.Signer
+
+	// Outbox queues feedback until it has been delivered; Store persists the pinned server key.
+	Outbox *FeedbackOutbox
+	Store  *RegistrationStore
+
+	Verification VerificationConfig
+	Reconnect    ReconnectPolicy
+
+	// Disconnected is displayed on the device while the api is unreachable; nil leaves the device as it is.
+	Disconnected *interchange.ControlMessage
+
+	// CommandBuffer is the amount of messages buffered between the subscriber and the processors.
+	CommandBuffer int
+
+	// HeartbeatDelay is the time between pings sent to keep the subscription alive.
+	HeartbeatDelay time.Duration
+
+	// ShutdownState is set on the device once the client has stopped (the zero value turns it off).
+	ShutdownState blink1.State
+
+	// ShutdownTimeout bounds how long queued feedback is given to be delivered when the client stops.
+	ShutdownTimeout time.Duration
+
+	// Logger defaults to the runtime logger when nil.
+	Logger logging.Logger
+
+	Hooks ClientHooks
+}
+
+// ClientHooks are called as the client moves through its lifecycle. Every hook is optional and is called from the
+// goroutine running the client, so they should return quickly.
+type ClientHooks struct {
+	// OnConnect is called whenever the subscription is (re-)established.
+	OnConnect func()
+
+	// OnDisconnect is called with the error that caused the subscription to be lost.
+	OnDisconnect func(error)
+
+	// OnRetry is called before waiting the given delay ahead of the numbered reconnect attempt.
+	OnRetry func(attempt uint, delay time.Duration)
+
+	// OnStop is called once the client has stopped, with the error (if any) that made it stop.
+	OnStop func(error)
+}
+
+// ErrReconnectExhausted is returned by Run when the reconnect policy gave up on the api.
+var ErrReconnectExhausted = fmt.Errorf("max-retries-reached")
+
+// NewClient validates the configuration and builds a client from it.
+func NewClient(config ClientConfig) (*Client, error) {
+	if config.Subscriber == nil || config.Device == nil || config.Decrypter == nil || config.Signer == nil {
+		return nil, fmt.Errorf("invalid-config: subscriber, device, decrypter and signer are required")
+	}
+
+	if config.Outbox == nil || config.Store == nil {
+		return nil, fmt.Errorf("invalid-config: outbox and store are required")
+	}
+
+	if config.HeartbeatDelay <= 0 {
+		return nil, fmt.Errorf("invalid-config: heartbeat delay must be positive")
+	}
+
+	if config.Reconnect.Initial <= 0 {
+		return nil, fmt.Errorf("invalid-config: reconnect delay must be positive")
+	}
+
+	// Every payload-bound message would be refused as stale without any allowance for clock skew.
+	if config.Verification.LegacyDigests != true && config.Verification.MaxClockSkew <= 0 {
+		return nil, fmt.Errorf("invalid-config: max clock skew must be positive")
+	}
+
+	if config.Logger == nil {
+		config.Logger = logging.New(defs.RuntimeLoggerPrefix, logging.Green)
+	}
+
+	return &Client{Logger: config.Logger, config: config}, nil
+}
+
+// Client connects a device to the api, feeding the messages it receives to the device and reconnecting according to
+// its reconnect policy whenever the subscription is lost.
+type Client struct {
+	logging.Logger
+
+	config ClientConfig
+
+	sync.Mutex
+	stop      context.CancelFunc
+	stopped   chan struct{}
+	heartbeat *HeartbeatProcessor
+	feedback  *FeedbackProcessor
+}
+
+// Run connects to the api and processes messages until the context is cancelled, Shutdown is called (both of which
+// return nil) or the reconnect policy is exhausted. The first connection is retried like any other, so a client started
+// while the api is unreachable waits for it instead of giving up.
+func (client *Client) Run(ctx context.Context) (e error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if e := client.begin(cancel); e != nil {
+		return e
+	}
+
+	defer client.finish()
+
+	defer func() {
+		if hook := client.settings().Hooks.OnStop; hook != nil {
+			hook(e)
+		}
+	}()
+
+	config := client.settings()
+
+	// If a device name was provided, pre-register the name with our shared secret before continuing. Failing to reach
+	// the api here is not fatal; the loop keeps retrying (registration included) according to the reconnect policy.
+	if config.DeviceName != "" {
+		if e := config.Subscriber.Preregister(config.DeviceName); e != nil {
+			client.Warnf("unable to register name \"%s\" with api: %s", config.DeviceName, e.Error())
+		}
+	}
+
+	if e := config.Subscriber.Connect(); e != nil {
+		client.Warnf("unable to open api subscription: %s (%s)", e.Error(), config.APIHome.String())
+	} else {
+		client.connected()
+	}
+
+	// Closing the subscriber is what unblocks a pending read once we've been asked to stop.
+	go func() {
+		<-ctx.Done()
+		config.Subscriber.Close()
+	}()
+
+	commandStream := make(chan *bytes.Buffer, config.CommandBuffer)
+	feedbackStream := make(chan *Feedback, config.CommandBuffer)
+
+	commands := NewCommandProcessor(
+		config.Device, config.Decrypter, commandStream, feedbackStream, config.Verification, config.Store,
+	)
+
+	heartbeat := NewHeartbeatProcessor(ctx, config.Subscriber, config.HeartbeatDelay, config.Reconnect.MaxRetries)
+	feedback := NewFeedbackProcessor(
+		ctx, feedbackStream, config.APIHome, config.Outbox, config.Signer, config.Verification, config.ShutdownTimeout,
+	)
+	processors := []Processor{heartbeat, feedback}
+
+	// Settings updated since the configuration was read above would otherwise be missed by the new processors.
+	client.Lock()
+	client.heartbeat, client.feedback = heartbeat, feedback
+	heartbeat.SetDelay(client.config.HeartbeatDelay)
+	heartbeat.SetMaxRetries(client.config.Reconnect.MaxRetries)
+	feedback.SetDrainTimeout(client.config.ShutdownTimeout)
+	client.Unlock()
+
+	// The command processor is waited on separately; it is the one writing into the feedback stream, so it has to have
+	// stopped before that stream can be closed.
+	commandSync, bgSync := sync.WaitGroup{}, sync.WaitGroup{}
+	commandSync.Add(1)
+	go commands.Start(&commandSync)
+
+	// Iterate over each background processor, spawining each in a goroutine with a sync.WaitGroup.
+	for _, p := range processors {
+		bgSync.Add(1)
+		go p.Start(&bgSync)
+	}
+
+	e = client.loop(ctx, commandStream, commands)
+
+	// Stop reading and terminate the command processor, which cancels whatever it is running. The subscriber is closed
+	// here as well; a reconnect that completed after the goroutine above closed it would otherwise be left open.
+	cancel()
+	config.Subscriber.Close()
+	close(commandStream)
+	commandSync.Wait()
+
+	// Closing the feedback stream makes the feedback processor drain what it can before everything else completes.
+	close(feedbackStream)
+	bgSync.Wait()
+
+	if e := config.Device.SetState(client.settings().ShutdownState); e != nil {
+		client.Warnf("unable to reset device on shutdown: %s", e.Error())
+	}
+
+	return e
+}
+
+// Shutdown stops a running client, waiting for Run to return.
+func (client *Client) Shutdown() {
+	client.Lock()
+	stop, stopped := client.stop, client.stopped
+	client.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	stop()
+	<-stopped
+}
+
+// Update applies the settings that can be changed while the client is running: the heartbeat delay, the reconnect
+// policy, the disconnected pattern and the shutdown state and timeout. The rest of the configuration is ignored;
+// changing it requires a new client.
+func (client *Client) Update(config ClientConfig) error {
+	if config.HeartbeatDelay <= 0 {
+		return fmt.Errorf("invalid-config: heartbeat delay must be positive")
+	}
+
+	if config.Reconnect.Initial <= 0 {
+		return fmt.Errorf("invalid-config: reconnect delay must be positive")
+	}
+
+	client.Lock()
+	defer client.Unlock()
+
+	client.config.HeartbeatDelay = config.HeartbeatDelay
+	client.config.Reconnect = config.Reconnect
+
+	// An identical pattern is not replaced, so that the device does not restart it needlessly.
+	if proto.Equal(client.config.Disconnected, config.Disconnected) != true {
+		client.config.Disconnected = config.Disconnected
+	}
+
+	client.config.ShutdownState = config.ShutdownState
+	client.config.ShutdownTimeout = config.ShutdownTimeout
+
+	if client.heartbeat != nil {
+		client.heartbeat.SetDelay(config.HeartbeatDelay)
+		client.heartbeat.SetMaxRetries(config.Reconnect.MaxRetries)
+	}
+
+	if client.feedback != nil {
+		client.feedback.SetDrainTimeout(config.ShutdownTimeout)
+	}
+
+	return nil
+}
+
+// loop reads from the subscriber into the command stream, reconnecting whenever a read fails.
+func (client *Client) loop(ctx context.Context, commandStream chan<- *bytes.Buffer, commands *CommandProcessor) error {
+	retries, shown := uint(0), (*interchange.ControlMessage)(nil)
+
+	for ctx.Err() == nil {
+		// Re-read the configuration every time around, picking up anything changed by Update.
+		config := client.settings()
+
+		if config.Subscriber.Connected() {
+			buffer := bytes.NewBuffer([]byte{})
+			e := config.Subscriber.ReadInto(buffer)
+
+			// If there was no error, send the buffer into our stream and continue on.
+			if e == nil {
+				commandStream <- buffer
+				continue
+			}
+
+			// Reads fail when we close the subscriber ourselves; that is not worth reporting.
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			client.Warnf("bad read: %s", e.Error())
+
+			if hook := config.Hooks.OnDisconnect; hook != nil {
+				hook(e)
+			}
+		}
+
+		// If we have reached our total count, give up.
+		if config.Reconnect.Exhausted(retries) {
+			client.Errorf("max retries (%d) reached, giving up", retries)
+			return ErrReconnectExhausted
+		}
+
+		// Let whoever is looking at the device know that we've lost the api as soon as the first attempt is needed (or
+		// as soon as the pattern has been changed).
+		if config.Disconnected != nil && config.Disconnected != shown {
+			commands.Display(config.Disconnected)
+			shown = config.Disconnected
+		}
+
+		delay := config.Reconnect.Delay(retries)
+		retries++
+		metrics.ReconnectAttempts.Inc()
+
+		if hook := config.Hooks.OnRetry; hook != nil {
+			hook(retries, delay)
+		}
+
+		logging.WithFields(client, logging.Fields{"attempt": retries, "delay": delay}).Infof("attempting retry")
+
+		if wait(ctx, delay) != true {
+			return nil
+		}
+
+		// If a device name was provided at startup, we need to pre-register again.
+		if config.DeviceName != "" {
+			e := config.Subscriber.Preregister(config.DeviceName)
+
+			// If we are unable to re-preregister (e.g the server is still down) continue on.
+			if e != nil {
+				client.Warnf("failed preregister \"%s\" on retry: %s", config.DeviceName, e.Error())
+			}
+		}
+
+		// Retry our connection attempt at this point, restoring the device once we are back.
+		if e := config.Subscriber.Connect(); e != nil {
+			client.Warnf("unable to reconnect: %s", e.Error())
+			continue
+		}
+
+		client.Infof("reconnected after %d retries", retries)
+		client.connected()
+		retries = 0
+
+		if shown != nil {
+			commands.Display(nil)
+			shown = nil
+		}
+	}
+
+	return nil
+}
+
+func (client *Client) settings() ClientConfig {
+	client.Lock()
+	defer client.Unlock()
+	return client.config
+}
+
+func (client *Client) connected() {
+	if hook := client.settings().Hooks.OnConnect; hook != nil {
+		hook()
+	}
+}
+
+// begin records how to stop the client, refusing to run the same client twice at once.
+func (client *Client) begin(stop context.CancelFunc) error {
+	client.Lock()
+	defer client.Unlock()
+
+	if client.stop != nil {
+		return fmt.Errorf("client-running")
+	}
+
+	client.stop, client.stopped = stop, make(chan struct{})
+	return nil
+}
+
+func (client *Client) finish() {
+	client.Lock()
+	defer client.Unlock()
+
+	close(client.stopped)
+	client.stop, client.stopped = nil, nil
+	client.heartbeat, client.feedback = nil, nil
+}
@@ -0,0 +1,229 @@
+package beacon
+
+import "io"
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "testing"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+// fakeSubscriber refuses the first few connection attempts; once connected, reads block until it is closed.
+type fakeSubscriber struct {
+	sync.Mutex
+	refusals int
+	attempts int
+	closing  chan struct{}
+}
+
+func (subscriber *fakeSubscriber) Connected() bool {
+	subscriber.Lock()
+	defer subscriber.Unlock()
+	return subscriber.closing != nil
+}
+
+func (subscriber *fakeSubscriber) ReadInto(writer io.Writer) error {
+	subscriber.Lock()
+	closing := subscriber.closing
+	subscriber.Unlock()
+
+	if closing == nil {
+		return fmt.Errorf("connection-closed")
+	}
+
+	<-closing
+	return fmt.Errorf("connection-closed")
+}
+
+func (subscriber *fakeSubscriber) Connect() error {
+	subscriber.Lock()
+	defer subscriber.Unlock()
+	subscriber.attempts++
+
+	if subscriber.attempts <= subscriber.refusals {
+		return fmt.Errorf("connection-refused")
+	}
+
+	subscriber.closing = make(chan struct{})
+	return nil
+}
+
+func (subscriber *fakeSubscriber) Close() error {
+	subscriber.Lock()
+	defer subscriber.Unlock()
+
+	if subscriber.closing != nil {
+		close(subscriber.closing)
+		subscriber.closing = nil
+	}
+
+	return nil
+}
+
+func (subscriber *fakeSubscriber) Preregister(name string) error {
+	return nil
+}
+
+func (subscriber *fakeSubscriber) Ping(data []byte) error {
+	return nil
+}
+
+func clientConfig(t *testing.T, subscriber Subscriber) ClientConfig {
+	t.Helper()
+	key, e := security.GenerateDeviceKey(security.ECDSAKeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	outbox, e := NewFeedbackOutbox(t.TempDir(), 10, defs.OutboxDropOldestPolicy)
+
+	if e != nil {
+		t.Fatalf("unable to open outbox: %s", e.Error())
+	}
+
+	return ClientConfig{
+		Subscriber:     subscriber,
+		Device:         newFakeDevice(),
+		Decrypter:      key,
+		Signer:         key,
+		Outbox:         outbox,
+		Store:          NewRegistrationStore(t.TempDir(), ""),
+		Reconnect:      ReconnectPolicy{Backoff: Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}},
+		HeartbeatDelay: time.Minute,
+		Verification:   VerificationConfig{MaxClockSkew: time.Minute},
+	}
+}
+
+func TestClientRetriesFirstConnection(t *testing.T) {
+	subscriber := &fakeSubscriber{refusals: 3}
+	config := clientConfig(t, subscriber)
+	connected, retries := make(chan struct{}, 1), uint(0)
+	config.Hooks.OnConnect = func() { connected <- struct{}{} }
+	config.Hooks.OnRetry = func(attempt uint, delay time.Duration) { retries = attempt }
+	client, e := NewClient(config)
+
+	if e != nil {
+		t.Fatalf("unable to create client: %s", e.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- client.Run(ctx)
+	}()
+
+	select {
+	case <-connected:
+	case e := <-stopped:
+		t.Fatalf("client stopped instead of retrying: %v", e)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client never connected")
+	}
+
+	cancel()
+
+	if e := <-stopped; e != nil {
+		t.Fatalf("expected a cancelled client to stop cleanly, got %s", e.Error())
+	}
+
+	if retries != 3 {
+		t.Fatalf("expected 3 retries before connecting, got %d", retries)
+	}
+}
+
+func TestClientGivesUpWhenNeverConnected(t *testing.T) {
+	config := clientConfig(t, &fakeSubscriber{refusals: 100})
+	config.Reconnect.MaxRetries = 2
+	client, e := NewClient(config)
+
+	if e != nil {
+		t.Fatalf("unable to create client: %s", e.Error())
+	}
+
+	if e := client.Run(context.Background()); e != ErrReconnectExhausted {
+		t.Fatalf("expected the reconnect policy to give up, got %v", e)
+	}
+}
+
+func TestNewClientRequiresReconnectDelay(t *testing.T) {
+	config := clientConfig(t, &fakeSubscriber{})
+	config.Reconnect.Initial = 0
+
+	if _, e := NewClient(config); e == nil {
+		t.Fatalf("expected a zero reconnect delay to be refused")
+	}
+}
+
+func TestNewClientRequiresClockSkew(t *testing.T) {
+	config := clientConfig(t, &fakeSubscriber{})
+	config.Verification = VerificationConfig{}
+
+	if _, e := NewClient(config); e == nil {
+		t.Fatalf("expected a zero max clock skew to be refused")
+	}
+
+	config.Verification.LegacyDigests = true
+
+	if _, e := NewClient(config); e != nil {
+		t.Fatalf("expected legacy digests to not need a max clock skew, got %s", e.Error())
+	}
+}
+
+func TestClientUpdatePassesMaxRetriesToTheHeartbeat(t *testing.T) {
+	config := clientConfig(t, &fakeSubscriber{})
+	config.Reconnect.MaxRetries = 2
+	connected := make(chan struct{}, 1)
+	config.Hooks.OnConnect = func() { connected <- struct{}{} }
+	client, e := NewClient(config)
+
+	if e != nil {
+		t.Fatalf("unable to create client: %s", e.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- client.Run(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client never connected")
+	}
+
+	// Retrying forever after a reload has to keep the heartbeat going through any outage as well.
+	config.Reconnect.MaxRetries = 0
+
+	if e := client.Update(config); e != nil {
+		t.Fatalf("unable to update client: %s", e.Error())
+	}
+
+	var heartbeat *HeartbeatProcessor
+
+	// The client connects before starting its processors.
+	for deadline := time.Now().Add(5 * time.Second); heartbeat == nil && time.Now().Before(deadline); {
+		client.Lock()
+		heartbeat = client.heartbeat
+		client.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	if heartbeat == nil {
+		t.Fatalf("client never started its heartbeat")
+	}
+
+	if retries := heartbeat.MaxRetries(); retries != 0 {
+		t.Fatalf("expected the heartbeat to retry forever after the update, got a limit of %d", retries)
+	}
+}
@@ -2,27 +2,46 @@ package beacon
 
 import "fmt"
 import "sync"
+import "time"
+import "context"
 import "bytes"
 import "crypto"
 import "crypto/rsa"
 import "crypto/rand"
 import "crypto/x509"
+import "crypto/subtle"
 import "encoding/hex"
-import "github.com/google/uuid"
 import "github.com/hink/go-blink1"
 import "github.com/golang/protobuf/proto"
 
 import "github.com/dadleyy/beacon.client/beacon/defs"
 import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
+import "github.com/dadleyy/beacon.client/beacon/security"
 import "github.com/dadleyy/beacon.client/beacon/interchange"
 
 // Decrypter is an alias for the crypto.Decrypter interface
 type Decrypter crypto.Decrypter
 
+// VerificationConfig controls how strictly the command processor authenticates the messages it receives.
+type VerificationConfig struct {
+	// LegacyDigests accepts digests that decrypt with the device key without being bound to the message contents,
+	// which is required by servers that predate payload-bound digests. Replay protection is disabled along with it, and
+	// feedback is sent with the plain payload digest those servers expect.
+	LegacyDigests bool
+
+	// MaxClockSkew is the furthest a message's issued-at timestamp may be from the local clock. It has to be positive
+	// unless LegacyDigests is set.
+	MaxClockSkew time.Duration
+}
+
 // NewCommandProcessor builds a new command processor w/ a default logger.
-func NewCommandProcessor(d Commandable, k Decrypter, c <-chan *bytes.Buffer, f chan<- *Feedback) Processor {
+func NewCommandProcessor(
+	d Commandable, k Decrypter, c <-chan *bytes.Buffer, f chan<- *Feedback, v VerificationConfig, s *RegistrationStore,
+) *CommandProcessor {
 	l := logging.New(defs.CommandProcessorLoggerPrefix, logging.Magenta)
-	return &CommandProcessor{l, k, d, c, f, nil, nil}
+	local := make(chan *interchange.ControlMessage)
+	return &CommandProcessor{l, k, d, c, f, v, s, make(map[string]uint64), local, nil, nil, blink1.State{}}
 }
 
 // CommandProcessor defines the main background processor that receives device messages and sends them to the device
@@ -33,9 +52,14 @@ type CommandProcessor struct {
 	device         Commandable
 	commandStream  <-chan *bytes.Buffer
 	feedbackStream chan<- *Feedback
-
-	latestMessage *uuid.UUID
-	registration  *RegistrationInfo
+	verification   VerificationConfig
+	store          *RegistrationStore
+	sequences      map[string]uint64
+	local          chan *interchange.ControlMessage
+
+	registration *RegistrationInfo
+	last         *interchange.ControlMessage
+	current      blink1.State
 }
 
 // Start initiates the reading of the command stream
@@ -43,73 +67,160 @@ func (processor *CommandProcessor) Start(wg *sync.WaitGroup) {
 	defer wg.Done()
 	processor.Infof("command processor starting")
 
-	// Iterate over the command stream channel for as long as we're open.
-	for buffer := range processor.commandStream {
-		message := &interchange.DeviceMessage{}
+	// Restore the pinned registration so that control messages are accepted before the next welcome message.
+	if pinned, e := processor.store.Load(); e != nil {
+		processor.Warnf("unable to restore pinned registration: %s", e.Error())
+	} else if pinned != nil {
+		logging.WithFields(processor, logging.Fields{"device_id": pinned.deviceID}).Infof("restored pinned registration")
+		processor.registration = pinned
+	}
 
-		// Attempt to unmarshal the buffer we've received into our device message protocol buffer.
-		if e := proto.UnmarshalMerge(buffer.Bytes(), message); e != nil {
-			processor.Warnf("unable to unmarshal protobuf message: %s", e.Error())
-			continue
-		}
+	// Restore the sequences accepted before the last restart; without them any recent message could be replayed.
+	if sequences, e := processor.store.LoadSequences(); e != nil {
+		processor.Warnf("unable to restore accepted message sequences: %s", e.Error())
+	} else {
+		processor.sequences = sequences
+	}
 
-		// Validate our message based on our Decrypter interface + the authentication's digest.
-		if e := processor.validateMessage(message); e != nil {
-			processor.Warnf("unable to validate message: %s", e.Error())
-			continue
-		}
+	// The executor goroutine is the only thing allowed to write to the device; executions are handed to it one at a
+	// time and the previous execution is cancelled before the next is sent, guaranteeing that sequences never overlap.
+	executions, executorSync, cancel := make(chan *execution), sync.WaitGroup{}, context.CancelFunc(func() {})
+	current := (*execution)(nil)
 
-		processor.Debugf("received message digest: %s", message.Authentication.MessageDigest[0:7])
+	executorSync.Add(1)
+	go processor.executor(executions, &executorSync)
 
-		// Decide which type of message this is.
-		switch message.Type {
-		case interchange.DeviceMessageType_WELCOME:
-			// If we'reve receved a welcome message, we need to extract the server public key from the message contents.
-			var e error
-			processor.registration, e = processor.parseWelcomeMessage(message)
+	defer executorSync.Wait()
+	defer close(executions)
+	defer func() { cancel() }()
 
-			if e != nil {
-				processor.Warnf("incorrect shared secret key, not rsa format: %s", e.Error())
-				continue
-			}
-		case interchange.DeviceMessageType_CONTROL:
-			control := &interchange.ControlMessage{}
+	// Hands the control message to the executor, cancelling whatever is currently executing; the executor will not
+	// receive the new execution until the previous one has stopped.
+	execute := func(control *interchange.ControlMessage) {
+		if current != nil && current.running() {
+			metrics.Preemptions.Inc()
+		}
+
+		cancel()
+		run, stop := processor.newExecution(control)
+		current, cancel = run, stop
+		executions <- run
+	}
 
-			// If we haven't received the server key, do nothing!
-			if processor.registration == nil {
-				processor.Warnf("have not received server key from welcome message, continuing")
-				continue
+	// Read from the command stream for as long as it is open, interleaving any locally requested patterns.
+	for {
+		select {
+		case control := <-processor.local:
+			// A nil control message resumes whatever the api last asked the device to show (or turns it off).
+			if control == nil && processor.last != nil {
+				control = processor.last
+			} else if control == nil {
+				control = &interchange.ControlMessage{Frames: []*interchange.ControlFrame{{}}}
 			}
 
-			// Attempt to unmarshal our message payload into our control message protocol buffer.
-			if e := proto.Unmarshal(message.GetPayload(), control); e != nil {
-				processor.Debugf("unable to unmarshal control payload: %s", e.Error())
-				continue
+			execute(control)
+		case buffer, ok := <-processor.commandStream:
+			if ok != true {
+				return
 			}
 
-			// If we received a strange control message (empty or w/o any frames), skip it.
-			if control == nil || len(control.Frames) == 0 {
-				processor.Debugf("skipping control message, no valid frames")
-				continue
+			if control := processor.handleMessage(buffer); control != nil {
+				execute(control)
 			}
+		}
+	}
+}
 
-			controlID, e := uuid.NewUUID()
+// Display interrupts whatever the device is currently showing with a locally generated control message (e.g the
+// pattern shown while disconnected from the api). Sending nil resumes the last control message received from the api.
+func (processor *CommandProcessor) Display(control *interchange.ControlMessage) {
+	processor.local <- control
+}
 
-			if e != nil {
-				processor.Warnf("unable to generate control id: %s", e.Error())
-				continue
-			}
+// handleMessage validates and applies the message, returning the control message that should be executed (if any).
+func (processor *CommandProcessor) handleMessage(buffer *bytes.Buffer) *interchange.ControlMessage {
+	message := &interchange.DeviceMessage{}
 
-			// Set the processor's latest message to allow execution interruption.
-			processor.latestMessage = &controlID
+	// Attempt to unmarshal the buffer we've received into our device message protocol buffer.
+	if e := proto.UnmarshalMerge(buffer.Bytes(), message); e != nil {
+		metrics.ValidationFailures.WithLabelValues(defs.UndecodableMessageErrorCategory).Inc()
+		processor.Warnf("unable to unmarshal protobuf message: %s", e.Error())
+		return nil
+	}
+
+	metrics.MessagesReceived.WithLabelValues(message.Type.String()).Inc()
+
+	// Validate our message based on our Decrypter interface + the authentication's digest.
+	if e := processor.validateMessage(message); e != nil {
+		metrics.ValidationFailures.WithLabelValues(errorCategory(e)).Inc()
+		processor.Warnf("unable to validate message: %s", e.Error())
+		processor.reportError(e)
+		return nil
+	}
+
+	// Everything logged about the message from here on is tagged with the device it was sent to.
+	logger := logging.WithFields(processor, logging.Fields{"device_id": message.Authentication.DeviceID})
+	logger.Debugf("received message digest: %s", logging.Secret(message.Authentication.MessageDigest[0:7]))
 
-			// Executre the control message in a goroutine, the previous attempt will terminate
-			go processor.execute(control, &controlID)
-		default:
-			// If we do not understand the type of the message, turn the device off.
-			processor.device.SetState(blink1.State{})
+	// Decide which type of message this is.
+	switch message.Type {
+	case interchange.DeviceMessageType_WELCOME:
+		// If we'reve receved a welcome message, we need to extract the server public key from the message contents.
+		registration, e := processor.parseWelcomeMessage(message)
+
+		if e != nil {
+			logger.Warnf("incorrect shared secret key, not rsa format: %s", e.Error())
+			return nil
+		}
+
+		// Refuse to trust a server key that differs from the one we have pinned (unless an operator approved it).
+		if e := processor.store.Pin(registration); e != nil {
+			logger.Errorf("refusing welcome message: %s", e.Error())
+			return nil
 		}
+
+		processor.registration = registration
+		return nil
+	case interchange.DeviceMessageType_CONTROL:
+		control := &interchange.ControlMessage{}
+
+		// If we haven't received the server key, do nothing!
+		if processor.registration == nil {
+			logger.Warnf("have not received server key from welcome message, continuing")
+			return nil
+		}
+
+		// Attempt to unmarshal our message payload into our control message protocol buffer.
+		if e := proto.Unmarshal(message.GetPayload(), control); e != nil {
+			logger.Debugf("unable to unmarshal control payload: %s", e.Error())
+			processor.reportError(NewFeedbackError(defs.BadPayloadErrorCategory, e))
+			return nil
+		}
+
+		// If we received a strange control message (empty or w/o any frames), skip it.
+		if control == nil || len(control.Frames) == 0 {
+			logger.Debugf("skipping control message, no valid frames")
+			return nil
+		}
+
+		processor.last = control
+		return control
+	default:
+		// If we do not understand the type of the message, turn the device off.
+		unknown := fmt.Errorf("unknown-type: %d", message.Type)
+		processor.reportError(NewFeedbackError(defs.UnknownMessageTypeErrorCategory, unknown))
+		processor.last = nil
+		return &interchange.ControlMessage{Frames: []*interchange.ControlFrame{{}}}
+	}
+}
+
+// reportError sends the (categorized) error to the feedback processor, provided we know who to report it to.
+func (processor *CommandProcessor) reportError(e error) {
+	if processor.registration == nil {
+		return
 	}
+
+	processor.feedbackStream <- &Feedback{Registration: processor.registration, Error: e}
 }
 
 func (processor *CommandProcessor) validateMessage(message *interchange.DeviceMessage) error {
@@ -118,17 +229,59 @@ func (processor *CommandProcessor) validateMessage(message *interchange.DeviceMe
 
 	if auth == nil {
 		processor.Warnf("received message missing authentication information, continuing")
-		return fmt.Errorf("invalid-authentication")
+		return NewFeedbackError(defs.MissingAuthenticationErrorCategory, fmt.Errorf("invalid-authentication"))
 	}
 
 	digestBytes, e := hex.DecodeString(auth.MessageDigest)
 
 	if e != nil {
-		return e
+		return NewFeedbackError(defs.DecryptFailureErrorCategory, e)
+	}
+
+	decrypted, e := processor.Decrypt(rand.Reader, digestBytes, nil)
+
+	if e != nil {
+		return NewFeedbackError(defs.DecryptFailureErrorCategory, e)
+	}
+
+	if processor.verification.LegacyDigests {
+		return nil
+	}
+
+	// The decrypted digest must match the hash of what we actually received, otherwise a captured digest could be
+	// replayed alongside an arbitrary payload.
+	expected := security.MessageDigest(uint32(message.Type), auth.DeviceID, auth.Sequence, auth.IssuedAt, message.Payload)
+
+	if subtle.ConstantTimeCompare(decrypted, expected) != 1 {
+		return NewFeedbackError(defs.DigestMismatchErrorCategory, fmt.Errorf("digest-mismatch"))
+	}
+
+	return processor.checkFreshness(auth)
+}
+
+// checkFreshness rejects messages issued outside of the clock skew window or whose sequence is not greater than the
+// highest sequence previously accepted for the same device id. Only called once the digest has been verified, so the
+// sequence and timestamp are known to be authentic.
+func (processor *CommandProcessor) checkFreshness(auth *interchange.DeviceMessageAuthentication) error {
+	issuedAt := time.Unix(0, auth.IssuedAt*int64(time.Millisecond))
+	skew := time.Since(issuedAt)
+
+	if skew < 0 {
+		skew = -skew
 	}
 
-	if _, e := processor.Decrypt(rand.Reader, digestBytes, nil); e != nil {
-		return e
+	if skew > processor.verification.MaxClockSkew {
+		return NewFeedbackError(defs.StaleMessageErrorCategory, fmt.Errorf("stale-message: issued %s", issuedAt))
+	}
+
+	if latest, ok := processor.sequences[auth.DeviceID]; ok && auth.Sequence <= latest {
+		return NewFeedbackError(defs.ReplayedMessageErrorCategory, fmt.Errorf("replayed-sequence: %d", auth.Sequence))
+	}
+
+	processor.sequences[auth.DeviceID] = auth.Sequence
+
+	if e := processor.store.SaveSequences(processor.sequences); e != nil {
+		processor.Warnf("unable to persist accepted message sequence: %s", e.Error())
 	}
 
 	return nil
@@ -148,6 +301,7 @@ func (processor *CommandProcessor) parseWelcomeMessage(message *interchange.Devi
 	}
 
 	processor.Debugf("received welcome, deviceID[%s]", auth.DeviceID)
+	logging.RegisterSecret(welcome.SharedSecret)
 	block, e := hex.DecodeString(welcome.SharedSecret)
 
 	if e != nil {
@@ -168,34 +322,3 @@ func (processor *CommandProcessor) parseWelcomeMessage(message *interchange.Devi
 
 	return &RegistrationInfo{serverKey, auth.DeviceID}, nil
 }
-
-func (processor *CommandProcessor) execute(control *interchange.ControlMessage, id *uuid.UUID) {
-	processor.Debugf("received control message w/ %d frames", len(control.Frames))
-
-	for _, frame := range control.Frames {
-		// If we have a latest message and it is not the same as the one we were given, skip everything.
-		if processor.latestMessage != nil && processor.latestMessage.String() != id.String() {
-			return
-		}
-
-		state := blink1.State{
-			Blue:  uint8(frame.Blue),
-			Red:   uint8(frame.Red),
-			Green: uint8(frame.Green),
-		}
-
-		if e := processor.device.SetState(state); e != nil {
-			processor.Errorf("unable to set device state, aborting control frames: %s", e.Error())
-			processor.feedbackStream <- &Feedback{Registration: processor.registration, Error: e}
-			return
-		}
-
-		processor.feedbackStream <- &Feedback{
-			Registration: processor.registration,
-			State:        state,
-		}
-	}
-
-	// We're now done, let future executions know there is no currently executing control message.
-	processor.latestMessage = nil
-}
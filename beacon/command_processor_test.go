@@ -0,0 +1,540 @@
+package beacon
+
+import "sync"
+import "time"
+import "bytes"
+import "testing"
+import "crypto/rsa"
+import "crypto/rand"
+import "sync/atomic"
+import "encoding/hex"
+import "github.com/hink/go-blink1"
+import "github.com/golang/protobuf/proto"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
+import "github.com/dadleyy/beacon.client/beacon/security"
+import "github.com/dadleyy/beacon.client/beacon/interchange"
+
+const testDeviceID = "test-device"
+
+// fakeDevice records every state it is sent, flagging calls to SetState that overlap one another.
+type fakeDevice struct {
+	sync.Mutex
+	states   []blink1.State
+	changes  chan blink1.State
+	inflight int32
+	overlaps int32
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{changes: make(chan blink1.State, 4096)}
+}
+
+func (device *fakeDevice) Close() {
+}
+
+func (device *fakeDevice) SetState(state blink1.State) error {
+	if atomic.AddInt32(&device.inflight, 1) > 1 {
+		atomic.AddInt32(&device.overlaps, 1)
+	}
+
+	defer atomic.AddInt32(&device.inflight, -1)
+
+	// Hold on to the call for a moment, giving an overlapping call the chance to show up.
+	time.Sleep(time.Millisecond)
+
+	device.Lock()
+	device.states = append(device.states, state)
+	device.Unlock()
+
+	select {
+	case device.changes <- state:
+	default:
+	}
+
+	return nil
+}
+
+func (device *fakeDevice) history() []blink1.State {
+	device.Lock()
+	defer device.Unlock()
+	return append([]blink1.State{}, device.states...)
+}
+
+// waitFor reads states from the device until one matches, failing the test if none does in time.
+func (device *fakeDevice) waitFor(t *testing.T, description string, match func(blink1.State) bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case state := <-device.changes:
+			if match(state) {
+				return
+			}
+		case <-timeout:
+			history := device.history()
+
+			if len(history) > 5 {
+				history = history[len(history)-5:]
+			}
+
+			t.Fatalf("timed out waiting for %s (last received %v)", description, history)
+		}
+	}
+}
+
+func isRed(state blink1.State) bool {
+	return state.Red > 0 && state.Green == 0 && state.Blue == 0
+}
+
+func isGreen(state blink1.State) bool {
+	return state.Green == 255 && state.Red == 0 && state.Blue == 0
+}
+
+func isBlue(state blink1.State) bool {
+	return state.Blue == 255 && state.Red == 0 && state.Green == 0
+}
+
+func isOff(state blink1.State) bool {
+	return state.Red == 0 && state.Green == 0 && state.Blue == 0
+}
+
+// processorHarness runs a command processor against a fake device, sending it authentic messages.
+type processorHarness struct {
+	*CommandProcessor
+	t        *testing.T
+	device   *fakeDevice
+	key      *security.DeviceKey
+	state    string
+	commands chan *bytes.Buffer
+	errors   chan error
+	sequence uint64
+	done     sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func startProcessor(t *testing.T) *processorHarness {
+	t.Helper()
+	key, e := security.GenerateDeviceKey(security.ECDSAKeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	serverKey, e := rsa.GenerateKey(rand.Reader, 1024)
+
+	if e != nil {
+		t.Fatalf("unable to generate server key: %s", e.Error())
+	}
+
+	// Pinning the registration up front lets the processor accept control messages without a welcome message.
+	state := t.TempDir()
+
+	if e := NewRegistrationStore(state, "").Pin(&RegistrationInfo{&serverKey.PublicKey, testDeviceID}); e != nil {
+		t.Fatalf("unable to pin registration: %s", e.Error())
+	}
+
+	return restartProcessor(t, key, state)
+}
+
+// restartProcessor starts a processor for the device key that picks up the state left behind by a previous one.
+func restartProcessor(t *testing.T, key *security.DeviceKey, state string) *processorHarness {
+	device, commands, feedback := newFakeDevice(), make(chan *bytes.Buffer), make(chan *Feedback)
+	verification := VerificationConfig{MaxClockSkew: time.Minute}
+	processor := NewCommandProcessor(device, key, commands, feedback, verification, NewRegistrationStore(state, ""))
+	harness := &processorHarness{
+		CommandProcessor: processor,
+		t:                t,
+		device:           device,
+		key:              key,
+		state:            state,
+		commands:         commands,
+		errors:           make(chan error, 100),
+	}
+
+	go func() {
+		for message := range feedback {
+			if message.Error != nil {
+				harness.errors <- message.Error
+			}
+		}
+	}()
+
+	harness.done.Add(1)
+	go processor.Start(&harness.done)
+
+	t.Cleanup(harness.stop)
+	return harness
+}
+
+// stop closes the command stream and waits (for a little while) for the processor to return.
+func (harness *processorHarness) stop() {
+	harness.stopOnce.Do(func() {
+		stopped := make(chan struct{})
+		close(harness.commands)
+
+		go func() {
+			harness.done.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			harness.t.Errorf("command processor did not stop, an execution was never cancelled")
+		}
+	})
+}
+
+// encode builds the message as the api would, with a valid digest and the next sequence.
+func (harness *processorHarness) encode(messageType interchange.DeviceMessageType, message proto.Message) []byte {
+	harness.t.Helper()
+	payload, e := proto.Marshal(message)
+
+	if e != nil {
+		harness.t.Fatalf("unable to marshal payload: %s", e.Error())
+	}
+
+	harness.sequence++
+	issuedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	digest := security.MessageDigest(uint32(messageType), testDeviceID, harness.sequence, issuedAt, payload)
+	encrypted, e := security.Encrypt(harness.key.Public(), digest)
+
+	if e != nil {
+		harness.t.Fatalf("unable to encrypt digest: %s", e.Error())
+	}
+
+	data, e := proto.Marshal(&interchange.DeviceMessage{
+		Type: messageType,
+		Authentication: &interchange.DeviceMessageAuthentication{
+			DeviceID:      testDeviceID,
+			MessageDigest: hex.EncodeToString(encrypted),
+			Sequence:      harness.sequence,
+			IssuedAt:      issuedAt,
+		},
+		Payload: payload,
+	})
+
+	if e != nil {
+		harness.t.Fatalf("unable to marshal message: %s", e.Error())
+	}
+
+	return data
+}
+
+func (harness *processorHarness) send(messageType interchange.DeviceMessageType, message proto.Message) {
+	harness.t.Helper()
+	harness.commands <- bytes.NewBuffer(harness.encode(messageType, message))
+}
+
+func (harness *processorHarness) control(message *interchange.ControlMessage) {
+	harness.t.Helper()
+	harness.send(interchange.DeviceMessageType_CONTROL, message)
+}
+
+func solid(red uint32, green uint32, blue uint32) *interchange.ControlMessage {
+	return &interchange.ControlMessage{Frames: []*interchange.ControlFrame{{Red: red, Green: green, Blue: blue}}}
+}
+
+func TestCommandProcessorPreemptsRunningMessages(t *testing.T) {
+	scenarios := map[string]*interchange.ControlMessage{
+		"loop": {
+			RepeatMode: interchange.ControlRepeatMode_LOOP,
+			Frames: []*interchange.ControlFrame{
+				{Red: 255, Duration: 10},
+				{Red: 128, Duration: 10},
+			},
+		},
+		"repeat": {
+			RepeatMode:  interchange.ControlRepeatMode_REPEAT,
+			RepeatCount: 1000,
+			Frames: []*interchange.ControlFrame{
+				{Red: 255, Duration: 10},
+				{Red: 64, Duration: 10},
+			},
+		},
+		"fade": {
+			Frames: []*interchange.ControlFrame{
+				{Red: 255, FadeTime: 5000},
+			},
+		},
+	}
+
+	for name, message := range scenarios {
+		message := message
+
+		t.Run(name, func(t *testing.T) {
+			harness := startProcessor(t)
+			harness.control(message)
+			harness.device.waitFor(t, "the first red state", isRed)
+			harness.device.waitFor(t, "another red state", isRed)
+
+			harness.control(solid(0, 255, 0))
+			harness.device.waitFor(t, "the preempting green state", isGreen)
+
+			// Give a preempted execution that is still running every chance to write to the device again.
+			time.Sleep(100 * time.Millisecond)
+			history := harness.device.history()
+			preempted := false
+
+			for _, state := range history {
+				preempted = preempted || isGreen(state)
+
+				if preempted && isGreen(state) != true {
+					t.Fatalf("device received %v after being preempted (history %v)", state, history)
+				}
+			}
+
+			if overlaps := atomic.LoadInt32(&harness.device.overlaps); overlaps != 0 {
+				t.Fatalf("%d calls to SetState overlapped", overlaps)
+			}
+		})
+	}
+}
+
+func TestCommandProcessorNeverInterleavesExecutions(t *testing.T) {
+	harness := startProcessor(t)
+	fade := &interchange.ControlMessage{
+		RepeatMode: interchange.ControlRepeatMode_PING_PONG,
+		Frames: []*interchange.ControlFrame{
+			{Red: 255, FadeTime: 100},
+			{Blue: 255, FadeTime: 100},
+		},
+	}
+
+	pattern, e := NewPattern(defs.BreathePatternName, "00ff00")
+
+	if e != nil {
+		t.Fatalf("unable to build pattern: %s", e.Error())
+	}
+
+	// Messages from the api and locally displayed patterns race each other for the device.
+	local := sync.WaitGroup{}
+	local.Add(1)
+
+	go func() {
+		defer local.Done()
+
+		for i := 0; i < 20; i++ {
+			harness.Display(pattern)
+			time.Sleep(7 * time.Millisecond)
+			harness.Display(nil)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		harness.control(fade)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	local.Wait()
+	harness.control(solid(0, 0, 255))
+	harness.device.waitFor(t, "the final blue state", isBlue)
+
+	if overlaps := atomic.LoadInt32(&harness.device.overlaps); overlaps != 0 {
+		t.Fatalf("%d calls to SetState overlapped", overlaps)
+	}
+}
+
+func TestCommandProcessorDisplayResumesLastMessage(t *testing.T) {
+	harness := startProcessor(t)
+
+	// Without anything received from the api, resuming turns the device off.
+	harness.Display(solid(255, 0, 0))
+	harness.device.waitFor(t, "the displayed red state", isRed)
+	harness.Display(nil)
+	harness.device.waitFor(t, "the device turning off", isOff)
+
+	harness.control(solid(0, 0, 255))
+	harness.device.waitFor(t, "the api's blue state", isBlue)
+
+	disconnected, e := NewPattern(defs.BreathePatternName, "ff0000")
+
+	if e != nil {
+		t.Fatalf("unable to build pattern: %s", e.Error())
+	}
+
+	harness.Display(disconnected)
+	harness.device.waitFor(t, "the disconnected pattern", isRed)
+	harness.Display(nil)
+	harness.device.waitFor(t, "the api's blue state to resume", isBlue)
+}
+
+func TestCommandProcessorRejectsReplaysAcrossRestarts(t *testing.T) {
+	first := startProcessor(t)
+	captured := first.encode(interchange.DeviceMessageType_CONTROL, solid(0, 0, 255))
+	first.commands <- bytes.NewBuffer(captured)
+	first.device.waitFor(t, "the original blue state", isBlue)
+	first.stop()
+
+	second := restartProcessor(t, first.key, first.state)
+	second.commands <- bytes.NewBuffer(captured)
+
+	select {
+	case e := <-second.errors:
+		if category := errorCategory(e); category != defs.ReplayedMessageErrorCategory {
+			t.Fatalf("expected the replay to be rejected as %s, got %s (%s)", defs.ReplayedMessageErrorCategory, category, e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("replayed message was not rejected")
+	}
+
+	if history := second.device.history(); len(history) != 0 {
+		t.Fatalf("replayed message reached the device: %v", history)
+	}
+}
+
+func TestCommandProcessorRejectsMismatchedDigests(t *testing.T) {
+	harness := startProcessor(t)
+	captured := harness.encode(interchange.DeviceMessageType_CONTROL, solid(0, 0, 255))
+	forged, e := proto.Marshal(solid(255, 0, 0))
+
+	if e != nil {
+		t.Fatalf("unable to marshal payload: %s", e.Error())
+	}
+
+	scenarios := []struct {
+		name   string
+		tamper func(*interchange.DeviceMessage)
+	}{
+		{"different payload", func(message *interchange.DeviceMessage) { message.Payload = forged }},
+		{"different type", func(message *interchange.DeviceMessage) {
+			message.Type = interchange.DeviceMessageType_WELCOME
+		}},
+		{"different sequence", func(message *interchange.DeviceMessage) { message.Authentication.Sequence += 10 }},
+		{"different device", func(message *interchange.DeviceMessage) { message.Authentication.DeviceID = "other" }},
+		{"different issue time", func(message *interchange.DeviceMessage) { message.Authentication.IssuedAt-- }},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			message := &interchange.DeviceMessage{}
+
+			if e := proto.Unmarshal(captured, message); e != nil {
+				t.Fatalf("unable to unmarshal captured message: %s", e.Error())
+			}
+
+			scenario.tamper(message)
+			data, e := proto.Marshal(message)
+
+			if e != nil {
+				t.Fatalf("unable to marshal tampered message: %s", e.Error())
+			}
+
+			harness.commands <- bytes.NewBuffer(data)
+
+			select {
+			case e := <-harness.errors:
+				if category := errorCategory(e); category != defs.DigestMismatchErrorCategory {
+					t.Fatalf("expected a %s error, got %s (%s)", defs.DigestMismatchErrorCategory, category, e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("tampered message was not rejected")
+			}
+		})
+	}
+
+	if history := harness.device.history(); len(history) != 0 {
+		t.Fatalf("tampered message reached the device: %v", history)
+	}
+
+	// The captured message itself is still authentic, and none of the tampered ones used up its sequence.
+	harness.commands <- bytes.NewBuffer(captured)
+	harness.device.waitFor(t, "the captured blue state", isBlue)
+}
+
+// validationFailures scrapes the metrics registry for the number of validation failures counted for the reason.
+func validationFailures(t *testing.T, reason string) float64 {
+	t.Helper()
+	families, e := metrics.Registry.Gather()
+
+	if e != nil {
+		t.Fatalf("unable to gather metrics: %s", e.Error())
+	}
+
+	for _, family := range families {
+		if family.GetName() != defs.MetricsNamespace+"_validation_failures_total" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" && label.GetValue() == reason {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestCommandProcessorCountsValidationFailures(t *testing.T) {
+	harness := startProcessor(t)
+	unauthenticated, e := proto.Marshal(&interchange.DeviceMessage{Type: interchange.DeviceMessageType_CONTROL})
+
+	if e != nil {
+		t.Fatalf("unable to marshal message: %s", e.Error())
+	}
+
+	captured := harness.encode(interchange.DeviceMessageType_CONTROL, solid(0, 0, 255))
+	mismatched := &interchange.DeviceMessage{}
+
+	if e := proto.Unmarshal(captured, mismatched); e != nil {
+		t.Fatalf("unable to unmarshal message: %s", e.Error())
+	}
+
+	mismatched.Authentication.Sequence++
+	tampered, e := proto.Marshal(mismatched)
+
+	if e != nil {
+		t.Fatalf("unable to marshal message: %s", e.Error())
+	}
+
+	scenarios := []struct {
+		reason string
+		data   []byte
+	}{
+		{defs.UndecodableMessageErrorCategory, []byte{0xff, 0xff, 0xff}},
+		{defs.MissingAuthenticationErrorCategory, unauthenticated},
+		{defs.DigestMismatchErrorCategory, tampered},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.reason, func(t *testing.T) {
+			before := validationFailures(t, scenario.reason)
+			unknown := validationFailures(t, defs.UnknownErrorCategory)
+			harness.commands <- bytes.NewBuffer(scenario.data)
+
+			for deadline := time.Now().Add(5 * time.Second); validationFailures(t, scenario.reason) == before; {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected a validation failure to be counted as %s", scenario.reason)
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if count := validationFailures(t, scenario.reason); count != before+1 {
+				t.Fatalf("expected a single %s failure to be counted, got %v", scenario.reason, count-before)
+			}
+
+			if validationFailures(t, defs.UnknownErrorCategory) != unknown {
+				t.Fatalf("expected the failure not to be counted as %s", defs.UnknownErrorCategory)
+			}
+		})
+	}
+
+	// Only messages that could be decoded are reported back to the api, each with its category.
+	for _, expected := range []string{defs.MissingAuthenticationErrorCategory, defs.DigestMismatchErrorCategory} {
+		select {
+		case e := <-harness.errors:
+			if category := errorCategory(e); category != expected {
+				t.Fatalf("expected a %s error to be reported, got %s (%s)", expected, category, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a %s error to be reported", expected)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package beacon
+
+import "sync"
+import "time"
+import "context"
+import "github.com/hink/go-blink1"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
+import "github.com/dadleyy/beacon.client/beacon/interchange"
+
+// execution pairs a control message with the context that will be cancelled when a newer message preempts it.
+type execution struct {
+	context.Context
+	control      *interchange.ControlMessage
+	registration *RegistrationInfo
+	done         chan struct{}
+}
+
+// newExecution snapshots the current registration alongside the control message so that the executor never reads
+// processor state written by the command stream goroutine.
+func (processor *CommandProcessor) newExecution(c *interchange.ControlMessage) (*execution, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &execution{ctx, c, processor.registration, make(chan struct{})}, cancel
+}
+
+// running returns true until the executor is done with the execution, whether it completed or was cancelled.
+func (run *execution) running() bool {
+	select {
+	case <-run.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// executor runs each execution received on the channel to completion (or cancellation) before receiving the next,
+// making it the sole owner of the device.
+func (processor *CommandProcessor) executor(executions <-chan *execution, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for run := range executions {
+		processor.execute(run)
+		close(run.done)
+	}
+}
+
+func (processor *CommandProcessor) execute(run *execution) {
+	control := run.control
+	processor.Debugf("received control message w/ %d frames (%s)", len(control.Frames), control.RepeatMode)
+
+	for pass := uint32(0); repeats(control, pass); pass++ {
+		frames := sequence(control, pass)
+
+		// Only report frames during the first pass, repeated passes would otherwise flood the api with feedback.
+		if processor.play(run, frames, pass == 0) != true {
+			return
+		}
+
+		// Prevent sequences without any timing from hammering the device while looping.
+		if duration(frames) == 0 && wait(run, defs.DeviceFadeStepInterval) != true {
+			return
+		}
+	}
+}
+
+// play sends each frame to the device, returning false if the execution was cancelled or the device failed.
+func (processor *CommandProcessor) play(run *execution, frames []*interchange.ControlFrame, report bool) bool {
+	for _, frame := range frames {
+		// If a newer message has preempted this one, skip everything.
+		if run.Err() != nil {
+			return false
+		}
+
+		state := blink1.State{
+			Blue:     uint8(frame.Blue),
+			Red:      uint8(frame.Red),
+			Green:    uint8(frame.Green),
+			FadeTime: time.Duration(frame.FadeTime) * time.Millisecond,
+		}
+
+		completed, e := processor.transition(run, state)
+
+		if e != nil {
+			processor.Errorf("unable to set device state, aborting control frames: %s", e.Error())
+
+			if run.registration != nil {
+				failure := NewFeedbackError(defs.DeviceUnavailableErrorCategory, e)
+				processor.feedbackStream <- &Feedback{Registration: run.registration, Error: failure}
+			}
+
+			return false
+		}
+
+		if completed != true {
+			return false
+		}
+
+		metrics.ControlFramesExecuted.Inc()
+
+		if report && run.registration != nil {
+			processor.feedbackStream <- &Feedback{
+				Registration: run.registration,
+				State:        state,
+			}
+		}
+
+		// Hold the frame for its duration before moving on to the next one.
+		if wait(run, time.Duration(frame.Duration)*time.Millisecond) != true {
+			return false
+		}
+	}
+
+	return true
+}
+
+// transition moves the device into the target state, interpolating through intermediate states when the device is
+// not able to fade on its own. The returned boolean will be false if the execution was cancelled mid-fade.
+func (processor *CommandProcessor) transition(run *execution, target blink1.State) (bool, error) {
+	steps := int64(target.FadeTime / defs.DeviceFadeStepInterval)
+
+	if steps <= 1 || fadesNatively(processor.device) {
+		if e := processor.device.SetState(target); e != nil {
+			return false, e
+		}
+
+		processor.current = target
+		return wait(run, target.FadeTime), nil
+	}
+
+	origin := processor.current
+
+	for step := int64(1); step <= steps; step++ {
+		state := interpolate(origin, target, step, steps)
+
+		if e := processor.device.SetState(state); e != nil {
+			return false, e
+		}
+
+		processor.current = state
+
+		if wait(run, defs.DeviceFadeStepInterval) != true {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// wait sleeps for the given duration, returning false early if the context is cancelled.
+func wait(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// repeats returns true if the control message's repeat mode calls for the given (zero-based) pass to be played. The
+// first pass is always played, so the meaning of a zero RepeatCount depends on the mode: REPEAT plays the frames once
+// (the same as a count of one), while PING_PONG keeps alternating until preempted, like LOOP.
+func repeats(control *interchange.ControlMessage, pass uint32) bool {
+	switch control.RepeatMode {
+	case interchange.ControlRepeatMode_REPEAT:
+		return pass == 0 || pass < control.RepeatCount
+	case interchange.ControlRepeatMode_LOOP:
+		return true
+	case interchange.ControlRepeatMode_PING_PONG:
+		return control.RepeatCount == 0 || pass < control.RepeatCount
+	}
+
+	return pass == 0
+}
+
+// sequence returns the frames that should be played during the given pass. Ping-pong passes alternate direction and
+// skip the frame they are turning around on so that it is not played twice in a row; a single frame is therefore only
+// played by the first pass, later ones hold it.
+func sequence(control *interchange.ControlMessage, pass uint32) []*interchange.ControlFrame {
+	frames := control.Frames
+
+	if control.RepeatMode != interchange.ControlRepeatMode_PING_PONG || pass == 0 || len(frames) == 0 {
+		return frames
+	}
+
+	if pass%2 == 0 {
+		return frames[1:]
+	}
+
+	reversed := make([]*interchange.ControlFrame, 0, len(frames))
+
+	for i := len(frames) - 2; i >= 0; i-- {
+		reversed = append(reversed, frames[i])
+	}
+
+	return reversed
+}
+
+// duration returns the total amount of milliseconds spent fading and holding the frames.
+func duration(frames []*interchange.ControlFrame) uint64 {
+	total := uint64(0)
+
+	for _, frame := range frames {
+		total += uint64(frame.Duration) + uint64(frame.FadeTime)
+	}
+
+	return total
+}
+
+// fadesNatively returns true for devices that honor the FadeTime of a blink1.State on their own.
+func fadesNatively(device Commandable) bool {
+	_, ok := device.(*blink1.Device)
+	return ok
+}
+
+// interpolate returns the state that is the given step of the total steps between the origin and the target.
+func interpolate(origin blink1.State, target blink1.State, step int64, steps int64) blink1.State {
+	channel := func(from uint8, to uint8) uint8 {
+		return uint8(int64(from) + (int64(to)-int64(from))*step/steps)
+	}
+
+	return blink1.State{
+		Red:   channel(origin.Red, target.Red),
+		Green: channel(origin.Green, target.Green),
+		Blue:  channel(origin.Blue, target.Blue),
+	}
+}
@@ -0,0 +1,213 @@
+package beacon
+
+import "time"
+import "context"
+import "testing"
+import "github.com/hink/go-blink1"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/interchange"
+
+// controlFrames returns frames told apart by their red channel, which is set to their index.
+func controlFrames(amount int) []*interchange.ControlFrame {
+	frames := make([]*interchange.ControlFrame, amount)
+
+	for i := range frames {
+		frames[i] = &interchange.ControlFrame{Red: uint32(i)}
+	}
+
+	return frames
+}
+
+// frameOrder returns the red channel (the index given by controlFrames) of each frame.
+func frameOrder(frames []*interchange.ControlFrame) []uint32 {
+	order := make([]uint32, len(frames))
+
+	for i, frame := range frames {
+		order[i] = frame.Red
+	}
+
+	return order
+}
+
+func TestRepeats(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		mode   interchange.ControlRepeatMode
+		count  uint32
+		passes uint32
+	}{
+		{"once", interchange.ControlRepeatMode_ONCE, 0, 1},
+		{"once ignores the count", interchange.ControlRepeatMode_ONCE, 5, 1},
+		{"repeat without a count plays once", interchange.ControlRepeatMode_REPEAT, 0, 1},
+		{"repeat a single time", interchange.ControlRepeatMode_REPEAT, 1, 1},
+		{"repeat counts passes", interchange.ControlRepeatMode_REPEAT, 3, 3},
+		{"ping-pong counts passes", interchange.ControlRepeatMode_PING_PONG, 4, 4},
+		{"ping-pong a single pass", interchange.ControlRepeatMode_PING_PONG, 1, 1},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			control := &interchange.ControlMessage{RepeatMode: scenario.mode, RepeatCount: scenario.count}
+			passes := uint32(0)
+
+			for passes < 100 && repeats(control, passes) {
+				passes++
+			}
+
+			if passes != scenario.passes {
+				t.Fatalf("expected %d passes, got %d", scenario.passes, passes)
+			}
+		})
+	}
+}
+
+func TestRepeatsForeverUntilPreempted(t *testing.T) {
+	scenarios := []*interchange.ControlMessage{
+		{RepeatMode: interchange.ControlRepeatMode_LOOP},
+		{RepeatMode: interchange.ControlRepeatMode_LOOP, RepeatCount: 2},
+		{RepeatMode: interchange.ControlRepeatMode_PING_PONG},
+	}
+
+	for _, control := range scenarios {
+		for _, pass := range []uint32{0, 1, 2, 1000, ^uint32(0)} {
+			if repeats(control, pass) != true {
+				t.Fatalf("expected %s (count %d) to play pass %d", control.RepeatMode, control.RepeatCount, pass)
+			}
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		mode     interchange.ControlRepeatMode
+		frames   int
+		expected [][]uint32
+	}{
+		{"repeat plays every pass forwards", interchange.ControlRepeatMode_REPEAT, 3, [][]uint32{
+			{0, 1, 2}, {0, 1, 2}, {0, 1, 2},
+		}},
+		{"loop plays every pass forwards", interchange.ControlRepeatMode_LOOP, 2, [][]uint32{
+			{0, 1}, {0, 1}, {0, 1},
+		}},
+		{"ping-pong turns around without repeating frames", interchange.ControlRepeatMode_PING_PONG, 3, [][]uint32{
+			{0, 1, 2}, {1, 0}, {1, 2}, {1, 0},
+		}},
+		{"ping-pong with two frames", interchange.ControlRepeatMode_PING_PONG, 2, [][]uint32{
+			{0, 1}, {0}, {1}, {0},
+		}},
+		{"ping-pong holds a single frame", interchange.ControlRepeatMode_PING_PONG, 1, [][]uint32{
+			{0}, {}, {}, {},
+		}},
+		{"ping-pong without frames", interchange.ControlRepeatMode_PING_PONG, 0, [][]uint32{
+			{}, {}, {},
+		}},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			control := &interchange.ControlMessage{RepeatMode: scenario.mode, Frames: controlFrames(scenario.frames)}
+
+			for pass, expected := range scenario.expected {
+				order := frameOrder(sequence(control, uint32(pass)))
+
+				if len(order) != len(expected) {
+					t.Fatalf("expected pass %d to play %v, got %v", pass, expected, order)
+				}
+
+				for i := range order {
+					if order[i] != expected[i] {
+						t.Fatalf("expected pass %d to play %v, got %v", pass, expected, order)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	origin := blink1.State{Red: 0, Green: 200, Blue: 100}
+	target := blink1.State{Red: 255, Green: 0, Blue: 100}
+
+	scenarios := []struct {
+		name     string
+		step     int64
+		steps    int64
+		expected blink1.State
+	}{
+		{"first step is the origin", 0, 10, origin},
+		{"midpoint", 5, 10, blink1.State{Red: 127, Green: 100, Blue: 100}},
+		{"uneven midpoint", 1, 3, blink1.State{Red: 85, Green: 134, Blue: 100}},
+		{"final step is the target", 10, 10, target},
+		{"single step is the target", 1, 1, target},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			if state := interpolate(origin, target, scenario.step, scenario.steps); state != scenario.expected {
+				t.Fatalf("expected step %d/%d to be %v, got %v", scenario.step, scenario.steps, scenario.expected, state)
+			}
+		})
+	}
+}
+
+func TestTransition(t *testing.T) {
+	origin := blink1.State{Red: 200}
+	target := blink1.State{Green: 200}
+
+	scenarios := []struct {
+		name     string
+		fade     time.Duration
+		expected []blink1.State
+	}{
+		{"without a fade", 0, []blink1.State{target}},
+		{"shorter than a step", defs.DeviceFadeStepInterval, []blink1.State{
+			{Green: 200, FadeTime: defs.DeviceFadeStepInterval},
+		}},
+		{"interpolated", 4 * defs.DeviceFadeStepInterval, []blink1.State{
+			{Red: 150, Green: 50}, {Red: 100, Green: 100}, {Red: 50, Green: 150}, target,
+		}},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			device := newFakeDevice()
+			processor := NewCommandProcessor(device, nil, nil, nil, VerificationConfig{}, nil)
+			processor.current = origin
+			run := &execution{Context: context.Background()}
+			goal := target
+			goal.FadeTime = scenario.fade
+
+			if completed, e := processor.transition(run, goal); completed != true || e != nil {
+				t.Fatalf("expected the transition to complete, got %v (%v)", completed, e)
+			}
+
+			history := device.history()
+
+			if len(history) != len(scenario.expected) {
+				t.Fatalf("expected states %v, got %v", scenario.expected, history)
+			}
+
+			for i := range history {
+				if history[i] != scenario.expected[i] {
+					t.Fatalf("expected states %v, got %v", scenario.expected, history)
+				}
+			}
+
+			if processor.current != history[len(history)-1] {
+				t.Fatalf("expected the current state to be the last one sent, got %v", processor.current)
+			}
+		})
+	}
+}
+
+func TestFadesNatively(t *testing.T) {
+	if fadesNatively(&blink1.Device{}) != true {
+		t.Fatalf("expected blink1 devices to fade on their own")
+	}
+
+	if fadesNatively(newFakeDevice()) {
+		t.Fatalf("expected other devices to have their fades interpolated")
+	}
+}
@@ -1,5 +1,7 @@
 package defs
 
+import "time"
+
 const (
 	// APIRegistrationEndpoint is used to open the websocket connection with the beacon api.
 	APIRegistrationEndpoint = "register"
@@ -15,4 +17,31 @@ const (
 
 	// APIReportMessageLabel is the label used when signing digests to the api during report feedback.
 	APIReportMessageLabel = "report"
+
+	// APIKeyRotationEndpoint is used to replace the shared secret of a device with a new one.
+	APIKeyRotationEndpoint = "/device-keys/rotate"
+
+	// APICloseFrameTimeout is how long the client waits to send the websocket close frame when disconnecting.
+	APICloseFrameTimeout = time.Second
+)
+
+const (
+	// OutboxDropOldestPolicy discards the oldest queued feedback when the outbox is full.
+	OutboxDropOldestPolicy = "drop-oldest"
+
+	// OutboxDropNewestPolicy refuses new feedback when the outbox is full.
+	OutboxDropNewestPolicy = "drop-newest"
+
+	// FeedbackRetryInitialDelay is the delay before the first retry of a failed feedback publish.
+	FeedbackRetryInitialDelay = time.Second
+
+	// FeedbackRetryMaxDelay is the longest the feedback processor will wait between publish attempts.
+	FeedbackRetryMaxDelay = 5 * time.Minute
+
+	// FeedbackPublishTimeout bounds each attempt to publish a feedback message, so that an api accepting connections
+	// without answering them cannot hold up the processor (and the device, which waits to hand it feedback).
+	FeedbackPublishTimeout = 10 * time.Second
+
+	// FeedbackRetryJitter is the fraction of each retry delay that is randomized.
+	FeedbackRetryJitter = 0.5
 )
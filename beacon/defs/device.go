@@ -0,0 +1,28 @@
+package defs
+
+import "time"
+
+const (
+	// DeviceFadeStepInterval is the amount of time between intermediate states when interpolating a fade.
+	DeviceFadeStepInterval = 20 * time.Millisecond
+)
+
+const (
+	// NonePatternName leaves the device as it is.
+	NonePatternName = "none"
+
+	// OffPatternName turns the device off.
+	OffPatternName = "off"
+
+	// SolidPatternName holds the color.
+	SolidPatternName = "solid"
+
+	// BlinkPatternName alternates between the color and off.
+	BlinkPatternName = "blink"
+
+	// BreathePatternName fades between the color and off.
+	BreathePatternName = "breathe"
+
+	// PatternPeriod is the amount of milliseconds each half of a blink or breathe pattern takes.
+	PatternPeriod = 1000
+)
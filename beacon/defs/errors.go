@@ -0,0 +1,34 @@
+package defs
+
+const (
+	// DeviceUnavailableErrorCategory is reported when the device could not be written to (e.g it has been unplugged).
+	DeviceUnavailableErrorCategory = "device-unavailable"
+
+	// MissingAuthenticationErrorCategory is reported when a message arrives without its authentication information.
+	MissingAuthenticationErrorCategory = "missing-authentication"
+
+	// DecryptFailureErrorCategory is reported when a message digest could not be decrypted with the device key.
+	DecryptFailureErrorCategory = "decrypt-failure"
+
+	// DigestMismatchErrorCategory is reported when a decrypted message digest does not match the message contents.
+	DigestMismatchErrorCategory = "digest-mismatch"
+
+	// StaleMessageErrorCategory is reported when a message was issued outside of the allowed clock skew window.
+	StaleMessageErrorCategory = "stale-message"
+
+	// ReplayedMessageErrorCategory is reported when a message sequence has already been seen for the device id.
+	ReplayedMessageErrorCategory = "replayed-message"
+
+	// BadPayloadErrorCategory is reported when a message payload could not be unmarshaled.
+	BadPayloadErrorCategory = "bad-payload"
+
+	// UnknownMessageTypeErrorCategory is reported when the device receives a message type it does not understand.
+	UnknownMessageTypeErrorCategory = "unknown-message-type"
+
+	// UndecodableMessageErrorCategory is counted when a message could not be unmarshaled at all. It is never reported
+	// to the api, as nothing in such a message can be trusted.
+	UndecodableMessageErrorCategory = "undecodable-message"
+
+	// UnknownErrorCategory is reported for errors that have not been categorized.
+	UnknownErrorCategory = "unknown"
+)
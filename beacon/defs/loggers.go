@@ -1,7 +1,5 @@
 package defs
 
-import "log"
-
 const (
 	// DebugLogLevelTag is used for debugf logger calls
 	DebugLogLevelTag = "debug"
@@ -30,6 +28,39 @@ const (
 	// CommandProcessorLoggerPrefix is used by the command processor
 	CommandProcessorLoggerPrefix = "[command processor] "
 
-	// DefaultLogFlags is a shared bitmask for default log.Logger flags
-	DefaultLogFlags = log.Ldate | log.Ltime
+	// DefaultLogTimeFormat is the layout of the time included in text log lines
+	DefaultLogTimeFormat = "2006/01/02 15:04:05"
+
+	// TextLogFormat selects the human readable (and, on a terminal, colored) log backend
+	TextLogFormat = "text"
+
+	// JSONLogFormat selects the backend writing one json object per line
+	JSONLogFormat = "json"
+
+	// StdoutLogOutput writes logs to stdout in the selected format
+	StdoutLogOutput = "stdout"
+
+	// SyslogLogOutput sends logs to the local syslog daemon
+	SyslogLogOutput = "syslog"
+
+	// JournaldLogOutput sends logs to journald using its native protocol
+	JournaldLogOutput = "journald"
+
+	// FileLogOutput writes logs to a file in the selected format, rotating it as it grows or ages
+	FileLogOutput = "file"
+
+	// LogRotationTimeFormat is the layout of the time appended to the name of rotated log files
+	LogRotationTimeFormat = "2006-01-02T15-04-05.000"
+
+	// JournaldSocketPath is where journald listens for native protocol datagrams
+	JournaldSocketPath = "/run/systemd/journal/socket"
+
+	// RedactedLogText replaces secrets in log messages
+	RedactedLogText = "[redacted]"
+
+	// MinimumRedactedLength is the length below which values are not masked wherever they appear
+	MinimumRedactedLength = 8
+
+	// LogIdentifier tags the messages sent to syslog and journald
+	LogIdentifier = "beacon-client"
 )
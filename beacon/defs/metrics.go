@@ -0,0 +1,18 @@
+package defs
+
+const (
+	// MetricsNamespace prefixes the name of every metric exported by the client
+	MetricsNamespace = "beacon_client"
+
+	// MetricsPath is where the metrics listener serves the metrics
+	MetricsPath = "/metrics"
+
+	// FeedbackPublishedResult labels feedback the api accepted
+	FeedbackPublishedResult = "published"
+
+	// FeedbackRejectedResult labels feedback the api refused (and that was dropped)
+	FeedbackRejectedResult = "rejected"
+
+	// FeedbackFailedResult labels feedback that could not be delivered and will be retried
+	FeedbackFailedResult = "failed"
+)
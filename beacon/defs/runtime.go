@@ -0,0 +1,27 @@
+package defs
+
+import "time"
+
+const (
+	// ExitCodeSuccess is used when the client was asked to stop and shut down cleanly.
+	ExitCodeSuccess = 0
+
+	// ExitCodeStartupFailure is used when the client could not be started (bad options, missing keys or device).
+	ExitCodeStartupFailure = 1
+
+	// ExitCodeConnectionLost is used when the client gave up reconnecting to the api.
+	ExitCodeConnectionLost = 2
+
+	// ExitCodeInterrupted is used when a second signal is received before the client finished shutting down.
+	ExitCodeInterrupted = 130
+)
+
+const (
+	// ConfigEnvPrefix is prepended to the (upper cased, underscored) name of a setting to get its environment variable.
+	ConfigEnvPrefix = "BEACON_"
+)
+
+const (
+	// ConfigWatchInterval is how often the config file is checked for changes when watching it.
+	ConfigWatchInterval = 2 * time.Second
+)
@@ -0,0 +1,9 @@
+package defs
+
+const (
+	// KeyPassphraseEnvVariable is the environment variable checked for the passphrase of an encrypted device key.
+	KeyPassphraseEnvVariable = "BEACON_KEY_PASSPHRASE"
+
+	// KeyPassphrasePrompt is displayed when prompting for the passphrase of an encrypted device key.
+	KeyPassphrasePrompt = "device key passphrase: "
+)
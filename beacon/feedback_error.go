@@ -0,0 +1,27 @@
+package beacon
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+// FeedbackError associates an error with the category it will be reported to the api under.
+type FeedbackError struct {
+	Category string
+	Err      error
+}
+
+// Error implements the error interface
+func (e *FeedbackError) Error() string {
+	return e.Err.Error()
+}
+
+// NewFeedbackError wraps the error with the provided category.
+func NewFeedbackError(category string, e error) error {
+	return &FeedbackError{category, e}
+}
+
+func errorCategory(e error) string {
+	if categorized, ok := e.(*FeedbackError); ok {
+		return categorized.Category
+	}
+
+	return defs.UnknownErrorCategory
+}
@@ -0,0 +1,128 @@
+package beacon
+
+import "os"
+import "fmt"
+import "sort"
+import "strings"
+import "io/ioutil"
+import "path/filepath"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+const outboxEntryExtension = ".feedback"
+
+// NewFeedbackOutbox opens (creating if necessary) the outbox stored in the given directory.
+func NewFeedbackOutbox(directory string, capacity int, policy string) (*FeedbackOutbox, error) {
+	if policy != defs.OutboxDropOldestPolicy && policy != defs.OutboxDropNewestPolicy {
+		return nil, fmt.Errorf("invalid-drop-policy: %s", policy)
+	}
+
+	if e := os.MkdirAll(directory, 0700); e != nil {
+		return nil, e
+	}
+
+	outbox := &FeedbackOutbox{directory: directory, capacity: capacity, policy: policy}
+	entries, e := outbox.entries()
+
+	if e != nil {
+		return nil, e
+	}
+
+	// Continue numbering entries after the newest one left over from a previous run.
+	if count := len(entries); count > 0 {
+		fmt.Sscanf(entries[count-1], "%d", &outbox.sequence)
+	}
+
+	return outbox, nil
+}
+
+// FeedbackOutbox is an on-disk, first-in-first-out queue of marshaled feedback messages awaiting delivery. It is not
+// safe for concurrent use; the feedback processor is its only owner.
+type FeedbackOutbox struct {
+	directory string
+	capacity  int
+	policy    string
+	sequence  uint64
+}
+
+// Push persists the payload at the end of the queue, applying the drop policy if the outbox is full.
+func (outbox *FeedbackOutbox) Push(payload []byte) error {
+	entries, e := outbox.entries()
+
+	if e != nil {
+		return e
+	}
+
+	for outbox.capacity > 0 && len(entries) >= outbox.capacity {
+		if outbox.policy == defs.OutboxDropNewestPolicy {
+			return fmt.Errorf("outbox-full")
+		}
+
+		if e := outbox.Remove(entries[0]); e != nil {
+			return e
+		}
+
+		entries = entries[1:]
+	}
+
+	outbox.sequence++
+	name := fmt.Sprintf("%020d%s", outbox.sequence, outboxEntryExtension)
+	temp := filepath.Join(outbox.directory, fmt.Sprintf(".%s.tmp", name))
+
+	// Write into a temporary file first so a crash mid-write never leaves a partial entry in the queue.
+	if e := ioutil.WriteFile(temp, payload, 0600); e != nil {
+		return e
+	}
+
+	return os.Rename(temp, filepath.Join(outbox.directory, name))
+}
+
+// Peek returns the name and contents of the oldest entry, or an empty name if the outbox is empty.
+func (outbox *FeedbackOutbox) Peek() (string, []byte, error) {
+	entries, e := outbox.entries()
+
+	if e != nil || len(entries) == 0 {
+		return "", nil, e
+	}
+
+	payload, e := ioutil.ReadFile(filepath.Join(outbox.directory, entries[0]))
+	return entries[0], payload, e
+}
+
+// Remove deletes the named entry from the outbox.
+func (outbox *FeedbackOutbox) Remove(name string) error {
+	e := os.Remove(filepath.Join(outbox.directory, name))
+
+	if os.IsNotExist(e) {
+		return nil
+	}
+
+	return e
+}
+
+// Len returns the amount of entries waiting in the outbox.
+func (outbox *FeedbackOutbox) Len() int {
+	entries, _ := outbox.entries()
+	return len(entries)
+}
+
+func (outbox *FeedbackOutbox) entries() ([]string, error) {
+	files, e := ioutil.ReadDir(outbox.directory)
+
+	if e != nil {
+		return nil, e
+	}
+
+	names := make([]string, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || filepath.Ext(f.Name()) != outboxEntryExtension {
+			continue
+		}
+
+		names = append(names, f.Name())
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
@@ -2,9 +2,13 @@ package beacon
 
 import "fmt"
 import "sync"
+import "time"
 import "bytes"
+import "context"
+import "sync/atomic"
 import "net/url"
 import "net/http"
+import "crypto"
 import "crypto/rsa"
 import "crypto/rand"
 import "encoding/hex"
@@ -14,6 +18,8 @@ import "github.com/golang/protobuf/proto"
 
 import "github.com/dadleyy/beacon.client/beacon/defs"
 import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
+import "github.com/dadleyy/beacon.client/beacon/security"
 import "github.com/dadleyy/beacon.client/beacon/interchange"
 
 // Feedback defines the structure of messages sent from the command processor to the feedback processor.
@@ -23,44 +29,133 @@ type Feedback struct {
 	State        blink1.State
 }
 
+// String describes the feedback, leaving out the registration (and the server key it holds).
+func (feedback *Feedback) String() string {
+	if feedback.Error != nil {
+		return fmt.Sprintf("error(%s)", feedback.Error.Error())
+	}
+
+	return fmt.Sprintf("report(rgb(%d,%d,%d))", feedback.State.Red, feedback.State.Green, feedback.State.Blue)
+}
+
 type publishRequest struct {
 	payloadData  []byte
 	payloadType  interchange.FeedbackMessageType
 	registration *RegistrationInfo
 }
 
-// NewFeedbackProcessor constructs a feedback processor
-func NewFeedbackProcessor(stream <-chan *Feedback, apiHome url.URL) Processor {
+// NewFeedbackProcessor constructs a feedback processor. Publishing is abandoned as soon as the context is cancelled;
+// once the stream is closed, the processor spends at most the drain timeout attempting to deliver whatever is still
+// queued before returning.
+func NewFeedbackProcessor(
+	ctx context.Context, stream <-chan *Feedback, apiHome url.URL, outbox *FeedbackOutbox, k crypto.Signer,
+	v VerificationConfig, drainTimeout time.Duration,
+) *FeedbackProcessor {
 	logger := logging.New(defs.FeedbackProcessorLoggerPrefix, logging.Blue)
-	return &FeedbackProcessor{logger, stream, apiHome}
+	backoff := Backoff{defs.FeedbackRetryInitialDelay, defs.FeedbackRetryMaxDelay, defs.FeedbackRetryJitter}
+	client := &http.Client{Timeout: defs.FeedbackPublishTimeout}
+	return &FeedbackProcessor{logger, k, ctx, client, stream, apiHome, outbox, backoff, v, int64(drainTimeout), 0}
 }
 
 // FeedbackProcessor communicates back to the api the current state of the device
 type FeedbackProcessor struct {
 	logging.Logger
+	crypto.Signer
 
-	stream  <-chan *Feedback
-	apiHome url.URL
+	ctx          context.Context
+	client       *http.Client
+	stream       <-chan *Feedback
+	apiHome      url.URL
+	outbox       *FeedbackOutbox
+	backoff      Backoff
+	verification VerificationConfig
+	drainTimeout int64
+	sequence     uint64
 }
 
-// Start should be used as the target of a goroutine - kicks of receiving on channel
+// Start should be used as the target of a goroutine - kicks of receiving on channel. Every message is persisted into
+// the outbox before being published so that nothing is lost while the api is unreachable (or across restarts).
 func (processor *FeedbackProcessor) Start(wg *sync.WaitGroup) {
 	defer wg.Done()
-	processor.Infof("starting feedback processor")
+	processor.Infof("starting feedback processor (%d queued)", processor.outbox.Len())
+
+	// Start with an immediate retry in order to drain anything left in the outbox from a previous run.
+	retry, attempts, waiting := time.NewTimer(0), uint(0), true
+	defer retry.Stop()
+
+	flush := func() {
+		e := processor.drain(processor.ctx)
+
+		if e == nil {
+			attempts, waiting = 0, false
+			return
+		}
+
+		// Publishing was abandoned because we are stopping; shutdown makes the final attempt.
+		if processor.ctx.Err() != nil {
+			waiting = true
+			return
+		}
+
+		delay := processor.backoff.Delay(attempts)
+		attempts, waiting = attempts+1, true
+		processor.Warnf("unable to publish feedback, retrying in %s (%d queued): %s", delay, processor.outbox.Len(), e)
+		retry.Reset(delay)
+	}
+
+	for {
+		select {
+		case message, ok := <-processor.stream:
+			if ok != true {
+				processor.shutdown()
+				return
+			}
+
+			processor.Debugf("received message on feedback stream, queueing for server, %s", message)
 
-	for message := range processor.stream {
-		processor.Debugf("received message on feedback stream, publishing to server, %v", message)
+			if message.Error != nil {
+				processor.queueError(message)
+			} else {
+				processor.queueReport(message)
+			}
 
-		if message.Error != nil {
-			processor.publishError(message)
-			continue
+			// If we are currently backing off, the message will be sent once the retry timer fires.
+			if waiting != true {
+				flush()
+			}
+		case <-retry.C:
+			flush()
 		}
+	}
+}
+
+// shutdown makes a final attempt at delivering the queued feedback, giving up once the drain timeout has passed.
+// Anything left over stays in the outbox for the next run. The processor's context has usually been cancelled by now
+// (abandoning whatever was being published), so the final attempt gets a context of its own.
+func (processor *FeedbackProcessor) shutdown() {
+	timeout := time.Duration(atomic.LoadInt64(&processor.drainTimeout))
+
+	if processor.outbox.Len() == 0 || timeout <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		processor.publishReport(message)
+	if e := processor.drain(ctx); e != nil {
+		processor.Warnf("unable to drain feedback on shutdown (%d queued): %s", processor.outbox.Len(), e.Error())
+		return
 	}
+
+	processor.Infof("drained feedback outbox before shutdown")
 }
 
-func (processor *FeedbackProcessor) publishReport(message *Feedback) {
+// SetDrainTimeout changes how long the processor spends delivering queued feedback once its stream is closed.
+func (processor *FeedbackProcessor) SetDrainTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&processor.drainTimeout, int64(timeout))
+}
+
+func (processor *FeedbackProcessor) queueReport(message *Feedback) {
 	payload, e := proto.Marshal(&interchange.ReportMessage{
 		Red:   uint32(message.State.Red),
 		Green: uint32(message.State.Green),
@@ -78,42 +173,86 @@ func (processor *FeedbackProcessor) publishReport(message *Feedback) {
 		registration: message.Registration,
 	}
 
-	if e := processor.publishPayload(req); e != nil {
-		processor.Errorf("unable to publish report: %s", e.Error())
+	if e := processor.queuePayload(req); e != nil {
+		processor.Errorf("unable to queue report: %s", e.Error())
 	}
-
-	processor.Infof("successfully published report")
 }
 
-func (processor *FeedbackProcessor) publishError(message *Feedback) {
+func (processor *FeedbackProcessor) queueError(message *Feedback) {
+	payload, e := proto.Marshal(&interchange.ErrorMessage{
+		ShortDescription: errorCategory(message.Error),
+		LongDescription:  message.Error.Error(),
+	})
+
+	if e != nil {
+		processor.Errorf("unable to marshal error: %s", e.Error())
+		return
+	}
+
+	req := &publishRequest{
+		payloadData:  payload,
+		payloadType:  interchange.FeedbackMessageType_ERROR,
+		registration: message.Registration,
+	}
+
+	if e := processor.queuePayload(req); e != nil {
+		processor.Errorf("unable to queue error: %s", e.Error())
+	}
 }
 
-func (processor *FeedbackProcessor) publishPayload(request *publishRequest) error {
-	s := sha256.New()
+// queuePayload signs and marshals the request into a feedback message and persists it in the outbox.
+func (processor *FeedbackProcessor) queuePayload(request *publishRequest) error {
+	registration, issuedAt := request.registration, time.Now()
 
-	if _, e := s.Write(request.payloadData); e != nil {
-		return e
+	// Sequences are seeded from the clock so that they keep increasing across restarts of the client.
+	processor.sequence++
+
+	if clock := uint64(issuedAt.UnixNano()); clock > processor.sequence {
+		processor.sequence = clock
 	}
 
-	digest := bytes.NewBuffer([]byte{})
-	signed, e := processor.sign(request.registration.serverKey, s.Sum(nil))
+	timestamp := issuedAt.UnixNano() / int64(time.Millisecond)
+	digest := security.MessageDigest(
+		uint32(request.payloadType), registration.deviceID, processor.sequence, timestamp, request.payloadData,
+	)
+
+	// Sign the digest with our own private key, allowing the api to verify the feedback came from this device.
+	signature, scheme, e := security.Sign(rand.Reader, processor.Signer, digest)
 
 	if e != nil {
 		return e
 	}
 
-	if _, e = digest.Write(signed); e != nil {
-		return e
+	algorithms := map[string]interchange.SignatureAlgorithm{
+		security.RSAPSSSignature:  interchange.SignatureAlgorithm_RSA_PSS_SHA256,
+		security.ECDSASignature:   interchange.SignatureAlgorithm_ECDSA_SHA256,
+		security.Ed25519Signature: interchange.SignatureAlgorithm_ED25519,
+	}
+
+	// The digest is also encrypted for the server. Servers that predate payload-bound digests only know how to check
+	// a plain sha256 of the payload, which is sent instead when legacy digests are enabled.
+	encryptedDigest := digest
+
+	if processor.verification.LegacyDigests {
+		legacy := sha256.Sum256(request.payloadData)
+		encryptedDigest = legacy[:]
 	}
 
-	// Encode the digest to hex.
-	digestString := hex.EncodeToString(digest.Bytes())
+	encrypted, e := processor.encryptDigest(registration.serverKey, encryptedDigest)
+
+	if e != nil {
+		return e
+	}
 
 	payload, e := proto.Marshal(&interchange.FeedbackMessage{
 		Type: request.payloadType,
 		Authentication: &interchange.DeviceMessageAuthentication{
-			MessageDigest: digestString,
-			DeviceID:      request.registration.deviceID,
+			MessageDigest:      hex.EncodeToString(encrypted),
+			DeviceID:           registration.deviceID,
+			Sequence:           processor.sequence,
+			IssuedAt:           timestamp,
+			Signature:          hex.EncodeToString(signature),
+			SignatureAlgorithm: algorithms[scheme],
 		},
 		Payload: request.payloadData,
 	})
@@ -122,18 +261,68 @@ func (processor *FeedbackProcessor) publishPayload(request *publishRequest) erro
 		return e
 	}
 
-	buf := bytes.NewBuffer(payload)
-	response, err := http.Post(processor.apiEndpoint(), defs.APIFeedbackContentTypeHeader, buf)
+	return processor.outbox.Push(payload)
+}
+
+// drain publishes the queued feedback messages in order, stopping at the first one that could not be delivered.
+func (processor *FeedbackProcessor) drain(ctx context.Context) error {
+	for ctx.Err() == nil {
+		name, payload, e := processor.outbox.Peek()
+
+		if e != nil || name == "" {
+			return e
+		}
+
+		started := time.Now()
+		status, e := processor.publish(ctx, payload)
+		metrics.FeedbackLatency.Observe(time.Since(started).Seconds())
 
-	if err != nil {
-		return err
+		if e != nil {
+			metrics.FeedbackPublished.WithLabelValues(defs.FeedbackFailedResult).Inc()
+			return e
+		}
+
+		logger := logging.WithFields(processor, logging.Fields{"feedback": name, "status": status})
+
+		// Client errors will never succeed no matter how many times they are retried; drop them instead of blocking.
+		if status/100 == 4 {
+			metrics.FeedbackPublished.WithLabelValues(defs.FeedbackRejectedResult).Inc()
+			logger.Errorf("api rejected feedback, dropping")
+		} else {
+			metrics.FeedbackPublished.WithLabelValues(defs.FeedbackPublishedResult).Inc()
+			logger.Infof("successfully published feedback")
+		}
+
+		if e := processor.outbox.Remove(name); e != nil {
+			return e
+		}
 	}
 
-	if response.StatusCode != 200 {
-		return fmt.Errorf("invalid response from server: %d", response.StatusCode)
+	return ctx.Err()
+}
+
+// publish sends the marshaled feedback message to the api, returning an error if it should be retried.
+func (processor *FeedbackProcessor) publish(ctx context.Context, payload []byte) (int, error) {
+	request, e := http.NewRequest(http.MethodPost, processor.apiEndpoint(), bytes.NewBuffer(payload))
+
+	if e != nil {
+		return 0, e
+	}
+
+	request.Header.Set("Content-Type", defs.APIFeedbackContentTypeHeader)
+	response, e := processor.client.Do(request.WithContext(ctx))
+
+	if e != nil {
+		return 0, e
+	}
+
+	defer response.Body.Close()
+
+	if class := response.StatusCode / 100; class == 2 || class == 4 {
+		return response.StatusCode, nil
 	}
 
-	return nil
+	return response.StatusCode, fmt.Errorf("invalid response from server: %d", response.StatusCode)
 }
 
 func (processor *FeedbackProcessor) apiEndpoint() string {
@@ -142,6 +331,6 @@ func (processor *FeedbackProcessor) apiEndpoint() string {
 	return u.String()
 }
 
-func (processor *FeedbackProcessor) sign(key *rsa.PublicKey, data []byte) ([]byte, error) {
+func (processor *FeedbackProcessor) encryptDigest(key *rsa.PublicKey, data []byte) ([]byte, error) {
 	return rsa.EncryptOAEP(sha256.New(), rand.Reader, key, data, []byte(defs.APIReportMessageLabel))
 }
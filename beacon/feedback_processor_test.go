@@ -0,0 +1,152 @@
+package beacon
+
+import "sync"
+import "time"
+import "context"
+import "testing"
+import "net/url"
+import "net/http"
+import "net/http/httptest"
+import "crypto/rsa"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "github.com/hink/go-blink1"
+import "github.com/golang/protobuf/proto"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/security"
+import "github.com/dadleyy/beacon.client/beacon/interchange"
+
+func TestFeedbackProcessorAbandonsStalledPublish(t *testing.T) {
+	received, release := make(chan struct{}, 16), make(chan struct{})
+
+	// The api accepts the connection and then never answers.
+	api := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received <- struct{}{}
+
+		select {
+		case <-release:
+		case <-request.Context().Done():
+		}
+	}))
+
+	t.Cleanup(api.Close)
+	t.Cleanup(func() { close(release) })
+
+	apiHome, _ := url.Parse(api.URL)
+	outbox, e := NewFeedbackOutbox(t.TempDir(), 10, defs.OutboxDropOldestPolicy)
+
+	if e != nil {
+		t.Fatalf("unable to open outbox: %s", e.Error())
+	}
+
+	key, e := security.GenerateDeviceKey(security.ECDSAKeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	serverKey, e := rsa.GenerateKey(rand.Reader, 1024)
+
+	if e != nil {
+		t.Fatalf("unable to generate server key: %s", e.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := make(chan *Feedback)
+	processor := NewFeedbackProcessor(ctx, stream, *apiHome, outbox, key, VerificationConfig{}, 100*time.Millisecond)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go processor.Start(&wg)
+
+	stream <- &Feedback{Registration: &RegistrationInfo{&serverKey.PublicKey, testDeviceID}, State: blink1.State{Red: 1}}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("feedback was never published")
+	}
+
+	// Stopping the client cancels the publish in flight; the final drain is bounded by the drain timeout.
+	stopping := time.Now()
+	cancel()
+	close(stream)
+	wg.Wait()
+
+	if elapsed := time.Since(stopping); elapsed > 2*time.Second {
+		t.Fatalf("feedback processor took %s to stop", elapsed)
+	}
+
+	if outbox.Len() != 1 {
+		t.Fatalf("expected the undelivered feedback to stay queued, found %d", outbox.Len())
+	}
+}
+
+func TestFeedbackProcessorEncryptsLegacyDigests(t *testing.T) {
+	key, e := security.GenerateDeviceKey(security.ECDSAKeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	serverKey, e := rsa.GenerateKey(rand.Reader, 1024)
+
+	if e != nil {
+		t.Fatalf("unable to generate server key: %s", e.Error())
+	}
+
+	for _, legacy := range []bool{false, true} {
+		outbox, e := NewFeedbackOutbox(t.TempDir(), 10, defs.OutboxDropOldestPolicy)
+
+		if e != nil {
+			t.Fatalf("unable to open outbox: %s", e.Error())
+		}
+
+		verification := VerificationConfig{LegacyDigests: legacy}
+		processor := NewFeedbackProcessor(context.Background(), nil, url.URL{}, outbox, key, verification, 0)
+		request := &publishRequest{
+			payloadData:  []byte("report"),
+			payloadType:  interchange.FeedbackMessageType_REPORT,
+			registration: &RegistrationInfo{&serverKey.PublicKey, testDeviceID},
+		}
+
+		if e := processor.queuePayload(request); e != nil {
+			t.Fatalf("unable to queue payload: %s", e.Error())
+		}
+
+		_, data, e := outbox.Peek()
+
+		if e != nil {
+			t.Fatalf("unable to read queued feedback: %s", e.Error())
+		}
+
+		message := &interchange.FeedbackMessage{}
+
+		if e := proto.Unmarshal(data, message); e != nil {
+			t.Fatalf("unable to unmarshal queued feedback: %s", e.Error())
+		}
+
+		auth := message.Authentication
+		encrypted, _ := hex.DecodeString(auth.MessageDigest)
+		label := []byte(defs.APIReportMessageLabel)
+		digest, e := rsa.DecryptOAEP(sha256.New(), rand.Reader, serverKey, encrypted, label)
+
+		if e != nil {
+			t.Fatalf("unable to decrypt digest: %s", e.Error())
+		}
+
+		expected := security.MessageDigest(uint32(message.Type), auth.DeviceID, auth.Sequence, auth.IssuedAt, message.Payload)
+
+		if legacy {
+			plain := sha256.Sum256(message.Payload)
+			expected = plain[:]
+		}
+
+		if hex.EncodeToString(digest) != hex.EncodeToString(expected) {
+			t.Fatalf("unexpected digest with legacy digests %v: %x", legacy, digest)
+		}
+	}
+}
@@ -2,47 +2,93 @@ package beacon
 
 import "sync"
 import "time"
+import "context"
+import "sync/atomic"
 
 import "github.com/dadleyy/beacon.client/beacon/defs"
 import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
 
-// NewHeartbeatProcessor creates a new processor for heartbeats
-func NewHeartbeatProcessor(pinger Pingable, delay time.Duration, retries uint) Processor {
+// NewHeartbeatProcessor creates a new processor for heartbeats that runs until the context is cancelled.
+func NewHeartbeatProcessor(
+	ctx context.Context, pinger Pingable, delay time.Duration, retries uint,
+) *HeartbeatProcessor {
 	logger := logging.New(defs.HeartbeatProcessorLoggerPrefix, logging.Cyan)
-	return &HeartbeatProcessor{logger, delay, pinger, retries}
+	return &HeartbeatProcessor{logger, ctx, int64(delay), pinger, uint64(retries)}
 }
 
 // HeartbeatProcessor is responsible for keeping the websocket connection alive
 type HeartbeatProcessor struct {
 	logging.Logger
-	delay      time.Duration
+	ctx        context.Context
+	delay      int64
 	pinger     Pingable
-	maxRetries uint
+	maxRetries uint64
 }
 
 // Start launches the hearbeat sequence
 func (processor *HeartbeatProcessor) Start(wg *sync.WaitGroup) {
 	defer wg.Done()
-	ticker, retries := time.NewTicker(processor.delay), 0
+	delay, retries := processor.Delay(), 0
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
 	processor.Infof("heartbeat processor starting")
 
-	for range ticker.C {
+	for {
+		select {
+		case <-processor.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Pick up any change made with SetDelay since the last tick.
+		if latest := processor.Delay(); latest != delay {
+			delay = latest
+			ticker.Stop()
+			ticker = time.NewTicker(delay)
+		}
+
 		e := processor.pinger.Ping([]byte("ping"))
 
-		if e != nil && retries < 100 {
+		if e != nil {
+			metrics.HeartbeatFailures.Inc()
+		}
+
+		// When reconnecting forever (no max retries), the heartbeat has to outlive any outage as well.
+		if e != nil && (processor.MaxRetries() == 0 || retries < 100) {
 			retries++
-			processor.Errorf("error pinging, retrying #%d in %f seconds (%s)", retries, processor.delay.Seconds(), e.Error())
-			time.Sleep(processor.delay)
+			processor.Errorf("error pinging, retrying #%d in %f seconds (%s)", retries, delay.Seconds(), e.Error())
+			wait(processor.ctx, delay)
 			continue
 		}
 
 		if e != nil {
 			processor.Errorf("unable to open up writer: %s", e.Error())
-			ticker.Stop()
 			break
 		}
 
+		retries = 0
 		processor.Debugf("successfully pinged api host")
 	}
 
 }
+
+// Delay returns the time currently waited between pings.
+func (processor *HeartbeatProcessor) Delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&processor.delay))
+}
+
+// SetDelay changes the time waited between pings, taking effect after the next ping.
+func (processor *HeartbeatProcessor) SetDelay(delay time.Duration) {
+	atomic.StoreInt64(&processor.delay, int64(delay))
+}
+
+// MaxRetries returns the reconnect limit the heartbeat follows; zero keeps it pinging through any outage.
+func (processor *HeartbeatProcessor) MaxRetries() uint {
+	return uint(atomic.LoadUint64(&processor.maxRetries))
+}
+
+// SetMaxRetries changes the reconnect limit the heartbeat follows, taking effect on the next failed ping.
+func (processor *HeartbeatProcessor) SetMaxRetries(retries uint) {
+	atomic.StoreUint64(&processor.maxRetries, uint64(retries))
+}
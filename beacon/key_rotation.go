@@ -0,0 +1,142 @@
+package beacon
+
+import "fmt"
+import "net"
+import "time"
+import "bytes"
+import "net/url"
+import "net/http"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+// keyRotationRequest is sent to the api when replacing a device key. Both keys sign the same digest; the current key
+// proves the request comes from the device and the replacement key proves the device actually holds it.
+type keyRotationRequest struct {
+	Secret                        string `json:"shared_secret"`
+	NewSecret                     string `json:"new_shared_secret"`
+	IssuedAt                      int64  `json:"issued_at"`
+	Signature                     string `json:"signature"`
+	SignatureAlgorithm            string `json:"signature_algorithm"`
+	ReplacementSignature          string `json:"new_signature"`
+	ReplacementSignatureAlgorithm string `json:"new_signature_algorithm"`
+}
+
+// KeyRotationRejectedError is returned by RotateDeviceKey when the rotation definitely did not happen; either the
+// request was never sent or the api refused it outright. Any other error leaves it unknown whether the api switched to
+// the replacement key.
+type KeyRotationRejectedError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (e *KeyRotationRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// RotateDeviceKey asks the api to replace the shared secret of the current key with the one of the replacement key,
+// returning nil only once the api has acknowledged the new shared secret.
+func RotateDeviceKey(apiHome url.URL, current security.Key, replacement security.Key) error {
+	secret, e := current.SharedSecret()
+
+	if e != nil {
+		return &KeyRotationRejectedError{e}
+	}
+
+	newSecret, e := replacement.SharedSecret()
+
+	if e != nil {
+		return &KeyRotationRejectedError{e}
+	}
+
+	request := keyRotationRequest{
+		Secret:    secret,
+		NewSecret: newSecret,
+		IssuedAt:  time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	// The digest covers both secrets and the time of the request so that it cannot be replayed for other keys.
+	s := sha256.New()
+	fmt.Fprintf(s, "%s\n%s\n%d", request.Secret, request.NewSecret, request.IssuedAt)
+	digest := s.Sum(nil)
+
+	signature, algorithm, e := security.Sign(rand.Reader, current, digest)
+
+	if e != nil {
+		return &KeyRotationRejectedError{e}
+	}
+
+	replacementSignature, replacementAlgorithm, e := security.Sign(rand.Reader, replacement, digest)
+
+	if e != nil {
+		return &KeyRotationRejectedError{e}
+	}
+
+	request.Signature, request.SignatureAlgorithm = hex.EncodeToString(signature), algorithm
+	request.ReplacementSignature = hex.EncodeToString(replacementSignature)
+	request.ReplacementSignatureAlgorithm = replacementAlgorithm
+
+	buf, e := json.Marshal(&request)
+
+	if e != nil {
+		return &KeyRotationRejectedError{e}
+	}
+
+	endpoint, e := url.Parse(apiHome.String())
+
+	if e != nil {
+		return &KeyRotationRejectedError{e}
+	}
+
+	endpoint.Path = defs.APIKeyRotationEndpoint
+	response, e := http.Post(endpoint.String(), "application/json", bytes.NewBuffer(buf))
+
+	if e != nil {
+		return rotationFailure(e)
+	}
+
+	defer response.Body.Close()
+
+	// Client errors are refused before anything changes; for anything else the api may already have committed.
+	if response.StatusCode >= 400 && response.StatusCode < 500 {
+		return &KeyRotationRejectedError{fmt.Errorf("rejected: %d", response.StatusCode)}
+	}
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("invalid-response: %d", response.StatusCode)
+	}
+
+	acknowledgement := struct {
+		Secret string `json:"shared_secret"`
+	}{}
+
+	if e := json.NewDecoder(response.Body).Decode(&acknowledgement); e != nil {
+		return fmt.Errorf("invalid-acknowledgement: %s", e.Error())
+	}
+
+	if acknowledgement.Secret != newSecret {
+		return fmt.Errorf("invalid-acknowledgement: shared secret mismatch")
+	}
+
+	return nil
+}
+
+// rotationFailure marks errors connecting to the api as rejections; a request that never left cannot have been
+// committed. Errors after the connection was made are left as they are.
+func rotationFailure(e error) error {
+	failure, ok := e.(*url.Error)
+
+	if ok != true {
+		return e
+	}
+
+	if connect, ok := failure.Err.(*net.OpError); ok && connect.Op == "dial" {
+		return &KeyRotationRejectedError{e}
+	}
+
+	return e
+}
@@ -0,0 +1,93 @@
+package beacon
+
+import "testing"
+import "net/url"
+import "net/http"
+import "encoding/json"
+import "net/http/httptest"
+
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+func TestRotateDeviceKeyDistinguishesRejections(t *testing.T) {
+	current, e := security.GenerateDeviceKey(security.ECDSAKeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	replacement, e := security.GenerateDeviceKey(security.Ed25519KeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	newSecret, e := replacement.SharedSecret()
+
+	if e != nil {
+		t.Fatalf("unable to read shared secret: %s", e.Error())
+	}
+
+	// Only refusals may be treated as the rotation not having happened; everything else is ambiguous.
+	scenarios := []struct {
+		name     string
+		status   int
+		body     interface{}
+		accepted bool
+		rejected bool
+	}{
+		{"acknowledged", http.StatusOK, map[string]string{"shared_secret": newSecret}, true, false},
+		{"refused", http.StatusBadRequest, nil, false, true},
+		{"unauthorized", http.StatusUnauthorized, nil, false, true},
+		{"server error", http.StatusInternalServerError, nil, false, false},
+		{"mismatched acknowledgement", http.StatusOK, map[string]string{"shared_secret": "other"}, false, false},
+		{"unreadable acknowledgement", http.StatusOK, "not an object", false, false},
+	}
+
+	for _, scenario := range scenarios {
+		scenario := scenario
+
+		t.Run(scenario.name, func(t *testing.T) {
+			api := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.WriteHeader(scenario.status)
+
+				if scenario.body != nil {
+					json.NewEncoder(response).Encode(scenario.body)
+				}
+			}))
+
+			defer api.Close()
+			apiHome, _ := url.Parse(api.URL)
+			e := RotateDeviceKey(*apiHome, current, replacement)
+			_, rejected := e.(*KeyRotationRejectedError)
+
+			if scenario.accepted {
+				if e != nil {
+					t.Fatalf("expected rotation to be acknowledged, got %s", e.Error())
+				}
+
+				return
+			}
+
+			if e == nil || rejected != scenario.rejected {
+				t.Fatalf("expected rejected=%v, got %v (%T)", scenario.rejected, e, e)
+			}
+		})
+	}
+}
+
+func TestRotateDeviceKeyUnreachableAPI(t *testing.T) {
+	current, e := security.GenerateDeviceKey(security.ECDSAKeyType, 0)
+
+	if e != nil {
+		t.Fatalf("unable to generate device key: %s", e.Error())
+	}
+
+	api := httptest.NewServer(http.NotFoundHandler())
+	apiHome, _ := url.Parse(api.URL)
+	api.Close()
+
+	// Nothing is listening any more, so the request can never have reached the api.
+	if _, rejected := RotateDeviceKey(*apiHome, current, current).(*KeyRotationRejectedError); rejected != true {
+		t.Fatalf("expected an unreachable api to count as a rejection")
+	}
+}
@@ -0,0 +1,201 @@
+package logging
+
+import "io"
+import "os"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "bytes"
+import "encoding/json"
+import "github.com/ttacon/chalk"
+import "golang.org/x/crypto/ssh/terminal"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+// Entry is a single log message on its way to a backend.
+type Entry struct {
+	Time      time.Time
+	Level     string
+	Prefix    string
+	Component string
+	Color     uint
+	Message   string
+	Fields    Fields
+}
+
+// Backend writes log entries somewhere; implementations must be safe for concurrent use.
+type Backend interface {
+	Write(*Entry)
+}
+
+var backend = struct {
+	sync.RWMutex
+	Backend
+}{Backend: NewTextBackend(os.Stdout, isTerminal(os.Stdout))}
+
+// SetBackend replaces the backend that every logger writes to, closing the previous one if it holds a connection.
+func SetBackend(b Backend) {
+	backend.Lock()
+	previous := backend.Backend
+	backend.Backend = b
+	backend.Unlock()
+
+	if closer, ok := previous.(io.Closer); ok && previous != b {
+		closer.Close()
+	}
+}
+
+// Reopen reopens the file written to by the current backend, if it writes to one. This lets external tools (e.g
+// logrotate) move the file out of the way.
+func Reopen() error {
+	if reopener, ok := currentBackend().(interface{ Reopen() error }); ok {
+		return reopener.Reopen()
+	}
+
+	return nil
+}
+
+func currentBackend() Backend {
+	backend.RLock()
+	defer backend.RUnlock()
+	return backend.Backend
+}
+
+// NewBackend returns the backend for the format (text or json) writing to the writer. Text is only colored when the
+// writer is a terminal.
+func NewBackend(format string, writer io.Writer) (Backend, error) {
+	switch format {
+	case defs.TextLogFormat:
+		return NewTextBackend(writer, isTerminal(writer)), nil
+	case defs.JSONLogFormat:
+		return NewJSONBackend(writer), nil
+	}
+
+	return nil, fmt.Errorf("invalid-log-format: %s", format)
+}
+
+// NewTextBackend returns a backend writing human readable lines, colored if requested.
+func NewTextBackend(writer io.Writer, colors bool) *TextBackend {
+	return &TextBackend{writer: writer, colors: colors}
+}
+
+// TextBackend writes each entry as a line prefixed by the component, time and level; fields follow the message as
+// key=value pairs.
+type TextBackend struct {
+	sync.Mutex
+	writer io.Writer
+	colors bool
+}
+
+// Write formats and writes the entry.
+func (text *TextBackend) Write(entry *Entry) {
+	prefix, label := entry.Prefix, fmt.Sprintf("[%s]", entry.Level)
+
+	if text.colors {
+		prefix, label = color(entry.Color, prefix), levelColor(entry.Level).Color(label)
+	}
+
+	line := bytes.NewBufferString(prefix)
+	fmt.Fprintf(line, "%s %s %s", entry.Time.Format(defs.DefaultLogTimeFormat), label, entry.Message)
+
+	for _, key := range sortedKeys(entry.Fields) {
+		fmt.Fprintf(line, " %s=%v", key, entry.Fields[key])
+	}
+
+	line.WriteByte('\n')
+
+	text.Lock()
+	defer text.Unlock()
+	text.writer.Write(line.Bytes())
+}
+
+// NewJSONBackend returns a backend writing one json object per line.
+func NewJSONBackend(writer io.Writer) *JSONBackend {
+	return &JSONBackend{writer: writer}
+}
+
+// JSONBackend writes each entry as a json object holding the time, level, component and message followed by the
+// fields of the entry.
+type JSONBackend struct {
+	sync.Mutex
+	writer io.Writer
+}
+
+// Write encodes and writes the entry.
+func (encoder *JSONBackend) Write(entry *Entry) {
+	line := bytes.NewBufferString("{")
+
+	writeField := func(key string, value interface{}) {
+		if line.Len() > 1 {
+			line.WriteByte(',')
+		}
+
+		name, _ := json.Marshal(key)
+		encoded, e := json.Marshal(jsonValue(value))
+
+		if e != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+
+		line.Write(name)
+		line.WriteByte(':')
+		line.Write(encoded)
+	}
+
+	writeField("time", entry.Time.Format(time.RFC3339Nano))
+	writeField("level", entry.Level)
+	writeField("component", entry.Component)
+	writeField("message", entry.Message)
+
+	for _, key := range sortedKeys(entry.Fields) {
+		writeField(key, entry.Fields[key])
+	}
+
+	line.WriteString("}\n")
+
+	encoder.Lock()
+	defer encoder.Unlock()
+	encoder.writer.Write(line.Bytes())
+}
+
+// jsonValue makes sure values that do not marshal into anything useful (errors, stringers) are output as text.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return value
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func levelColor(level string) chalk.Color {
+	switch level {
+	case defs.ErrorLogLevelTag:
+		return chalk.Red
+	case defs.WarnLogLevelTag:
+		return chalk.Yellow
+	case defs.InfoLogLevelTag:
+		return chalk.Cyan
+	}
+
+	return chalk.Blue
+}
+
+func isTerminal(writer io.Writer) bool {
+	file, ok := writer.(*os.File)
+	return ok && terminal.IsTerminal(int(file.Fd()))
+}
@@ -0,0 +1,96 @@
+package logging
+
+import "io"
+import "fmt"
+import "net"
+import "sync"
+import "bytes"
+import "strings"
+import "unicode"
+import "encoding/binary"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+// journaldPriorities maps log levels onto the syslog priorities understood by journald.
+var journaldPriorities = map[string]string{
+	defs.ErrorLogLevelTag: "3",
+	defs.WarnLogLevelTag:  "4",
+	defs.InfoLogLevelTag:  "6",
+	defs.DebugLogLevelTag: "7",
+}
+
+// NewJournaldBackend connects to the journald socket (usually defs.JournaldSocketPath), tagging entries with the
+// identifier.
+func NewJournaldBackend(identifier string, socket string) (*JournaldBackend, error) {
+	connection, e := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &JournaldBackend{connection: connection, identifier: identifier}, nil
+}
+
+// JournaldBackend sends entries to journald using its native protocol, keeping the component and the fields of each
+// entry as separate journal fields (e.g COMPONENT and DEVICE_ID).
+type JournaldBackend struct {
+	sync.Mutex
+	connection *net.UnixConn
+	identifier string
+}
+
+// Write sends the entry to journald as a single datagram.
+func (backend *JournaldBackend) Write(entry *Entry) {
+	datagram := bytes.NewBuffer([]byte{})
+
+	writeJournalField(datagram, "MESSAGE", entry.Message)
+	writeJournalField(datagram, "PRIORITY", journaldPriorities[entry.Level])
+	writeJournalField(datagram, "SYSLOG_IDENTIFIER", backend.identifier)
+	writeJournalField(datagram, "COMPONENT", entry.Component)
+
+	for _, key := range sortedKeys(entry.Fields) {
+		if name := journalFieldName(key); name != "" {
+			writeJournalField(datagram, name, fmt.Sprint(entry.Fields[key]))
+		}
+	}
+
+	backend.Lock()
+	defer backend.Unlock()
+	backend.connection.Write(datagram.Bytes())
+}
+
+// Close disconnects from journald.
+func (backend *JournaldBackend) Close() error {
+	return backend.connection.Close()
+}
+
+// writeJournalField appends the field to the datagram; values spanning multiple lines are written with their length
+// instead of being terminated by a newline, as required by the protocol.
+func writeJournalField(datagram io.Writer, name string, value string) {
+	if strings.ContainsRune(value, '\n') != true {
+		io.WriteString(datagram, name+"="+value+"\n")
+		return
+	}
+
+	io.WriteString(datagram, name+"\n")
+	binary.Write(datagram, binary.LittleEndian, uint64(len(value)))
+	io.WriteString(datagram, value+"\n")
+}
+
+// journalFieldName converts a field key into a valid journal field name (upper case letters, digits and underscores
+// not starting with an underscore), returning an empty string if nothing is left of it.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return -1
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+
+		return '_'
+	}, key)
+
+	return strings.TrimLeft(name, "_0123456789")
+}
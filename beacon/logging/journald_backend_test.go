@@ -0,0 +1,103 @@
+package logging
+
+import "net"
+import "bytes"
+import "testing"
+import "path/filepath"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+func TestWriteJournalField(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		value    string
+		expected []byte
+	}{
+		{"single line", "connected", []byte("MESSAGE=connected\n")},
+		{"empty value", "", []byte("MESSAGE=\n")},
+		{"value containing an equals sign", "a=b", []byte("MESSAGE=a=b\n")},
+		{"multiple lines", "first\nsecond", append(
+			[]byte("MESSAGE\n\x0c\x00\x00\x00\x00\x00\x00\x00"), []byte("first\nsecond\n")...,
+		)},
+		{"trailing newline", "line\n", append([]byte("MESSAGE\n\x05\x00\x00\x00\x00\x00\x00\x00"), []byte("line\n\n")...)},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			datagram := bytes.NewBuffer([]byte{})
+			writeJournalField(datagram, "MESSAGE", scenario.value)
+
+			if bytes.Equal(datagram.Bytes(), scenario.expected) != true {
+				t.Fatalf("expected %q, got %q", scenario.expected, datagram.Bytes())
+			}
+		})
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	scenarios := []struct {
+		key      string
+		expected string
+	}{
+		{"device_id", "DEVICE_ID"},
+		{"DeviceID", "DEVICEID"},
+		{"remote-addr", "REMOTE_ADDR"},
+		{"http.status code", "HTTP_STATUS_CODE"},
+		{"_private", "PRIVATE"},
+		{"2fa_token", "FA_TOKEN"},
+		{"__1_x", "X"},
+		{"naïve", "NAVE"},
+		{"_-_", ""},
+		{"", ""},
+	}
+
+	for _, scenario := range scenarios {
+		if name := journalFieldName(scenario.key); name != scenario.expected {
+			t.Fatalf("expected %q to become %q, got %q", scenario.key, scenario.expected, name)
+		}
+	}
+}
+
+func TestJournaldBackendWrite(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	journal, e := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if e != nil {
+		t.Fatalf("unable to listen on journal socket: %s", e.Error())
+	}
+
+	defer journal.Close()
+	backend, e := NewJournaldBackend("beacon-client", socket)
+
+	if e != nil {
+		t.Fatalf("unable to connect to journal socket: %s", e.Error())
+	}
+
+	defer backend.Close()
+
+	backend.Write(&Entry{
+		Level:     defs.WarnLogLevelTag,
+		Component: "command-processor",
+		Message:   "unable to validate message",
+		Fields:    Fields{"device_id": "lobby", "-": "dropped", "error": "first\nsecond"},
+	})
+
+	received := make([]byte, 4096)
+	size, e := journal.Read(received)
+
+	if e != nil {
+		t.Fatalf("unable to read datagram: %s", e.Error())
+	}
+
+	expected := bytes.NewBuffer([]byte{})
+	expected.WriteString("MESSAGE=unable to validate message\n")
+	expected.WriteString("PRIORITY=4\n")
+	expected.WriteString("SYSLOG_IDENTIFIER=beacon-client\n")
+	expected.WriteString("COMPONENT=command-processor\n")
+	expected.WriteString("DEVICE_ID=lobby\n")
+	writeJournalField(expected, "ERROR", "first\nsecond")
+
+	if bytes.Equal(received[:size], expected.Bytes()) != true {
+		t.Fatalf("expected datagram %q, got %q", expected.Bytes(), received[:size])
+	}
+}
@@ -0,0 +1,106 @@
+package logging
+
+import "fmt"
+import "sync"
+import "strings"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+// levelRanks orders the levels from the most to the least verbose.
+var levelRanks = map[string]int{
+	defs.DebugLogLevelTag: 0,
+	defs.InfoLogLevelTag:  1,
+	defs.WarnLogLevelTag:  2,
+	defs.ErrorLogLevelTag: 3,
+}
+
+// Levels are the minimum levels logged by every component and by the components overriding it.
+type Levels struct {
+	global     int
+	components map[string]int
+}
+
+var levels = struct {
+	sync.RWMutex
+	Levels
+}{Levels: Levels{components: make(map[string]int)}}
+
+// ParseLevels checks the global level and the levels of the components given (keyed by their logger prefix, e.g
+// "heartbeat processor" or "heartbeat-processor"), returning them ready to be applied.
+func ParseLevels(global string, components map[string]string) (Levels, error) {
+	rank, ok := levelRanks[global]
+
+	if ok != true {
+		return Levels{}, fmt.Errorf("invalid-log-level: %s", global)
+	}
+
+	ranks := make(map[string]int, len(components))
+
+	for component, level := range components {
+		if ranks[ComponentKey(component)], ok = levelRanks[level]; ok != true {
+			return Levels{}, fmt.Errorf("invalid-log-level: %s (%s)", level, component)
+		}
+	}
+
+	return Levels{global: rank, components: ranks}, nil
+}
+
+// ApplyLevels sets the minimum level logged by every component to the parsed levels.
+func ApplyLevels(parsed Levels) {
+	levels.Lock()
+	defer levels.Unlock()
+	levels.Levels = parsed
+}
+
+// SetLevels sets the minimum level logged by every component, overridden for the components given.
+func SetLevels(global string, components map[string]string) error {
+	parsed, e := ParseLevels(global, components)
+
+	if e != nil {
+		return e
+	}
+
+	ApplyLevels(parsed)
+	return nil
+}
+
+// ParseComponentLevels parses a comma separated list of component=level pairs.
+func ParseComponentLevels(value string) (map[string]string, error) {
+	components := make(map[string]string)
+
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid-component-level: %s", pair)
+		}
+
+		components[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return components, nil
+}
+
+// ComponentKey normalizes a logger prefix or component name (e.g "[command processor] " or "command-processor") into
+// the key its level is stored under.
+func ComponentKey(name string) string {
+	key := strings.ToLower(strings.Trim(name, "[] "))
+	return strings.NewReplacer("-", " ", "_", " ").Replace(key)
+}
+
+func enabled(component string, level string) bool {
+	levels.RLock()
+	defer levels.RUnlock()
+
+	minimum, ok := levels.components[component]
+
+	if ok != true {
+		minimum = levels.global
+	}
+
+	return levelRanks[level] >= minimum
+}
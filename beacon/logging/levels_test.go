@@ -0,0 +1,150 @@
+package logging
+
+import "os"
+import "fmt"
+import "testing"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+func TestParseLevels(t *testing.T) {
+	scenarios := []struct {
+		name       string
+		global     string
+		components map[string]string
+		valid      bool
+		expected   Levels
+	}{
+		{"global only", defs.WarnLogLevelTag, nil, true, Levels{2, map[string]int{}}},
+		{"component overrides", defs.InfoLogLevelTag, map[string]string{
+			"[heartbeat processor] ": defs.DebugLogLevelTag,
+			"state-logger":           defs.ErrorLogLevelTag,
+		}, true, Levels{1, map[string]int{"heartbeat processor": 0, "state logger": 3}}},
+		{"unknown components are kept", defs.ErrorLogLevelTag, map[string]string{
+			"not-a-component": defs.DebugLogLevelTag,
+		}, true, Levels{3, map[string]int{"not a component": 0}}},
+		{"invalid global level", "verbose", nil, false, Levels{}},
+		{"empty global level", "", nil, false, Levels{}},
+		{"levels are case sensitive", "DEBUG", nil, false, Levels{}},
+		{"invalid component level", defs.InfoLogLevelTag, map[string]string{"state-logger": "loud"}, false, Levels{}},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			parsed, e := ParseLevels(scenario.global, scenario.components)
+
+			if (e == nil) != scenario.valid {
+				t.Fatalf("expected valid: %v, got %v", scenario.valid, e)
+			}
+
+			if fmt.Sprint(parsed) != fmt.Sprint(scenario.expected) {
+				t.Fatalf("expected %v, got %v", scenario.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestParseComponentLevels(t *testing.T) {
+	scenarios := []struct {
+		value    string
+		valid    bool
+		expected map[string]string
+	}{
+		{"", true, map[string]string{}},
+		{"state-logger=debug", true, map[string]string{"state-logger": "debug"}},
+		{" state-logger = debug , heartbeat-processor=warn,", true, map[string]string{
+			"state-logger":        "debug",
+			"heartbeat-processor": "warn",
+		}},
+		{",,", true, map[string]string{}},
+		{"state-logger=debug=warn", true, map[string]string{"state-logger": "debug=warn"}},
+		{"state-logger", false, nil},
+		{"state-logger=debug,heartbeat-processor", false, nil},
+	}
+
+	for _, scenario := range scenarios {
+		components, e := ParseComponentLevels(scenario.value)
+
+		if (e == nil) != scenario.valid {
+			t.Fatalf("expected %q to be valid: %v, got %v", scenario.value, scenario.valid, e)
+		}
+
+		if fmt.Sprint(components) != fmt.Sprint(scenario.expected) {
+			t.Fatalf("expected %q to parse as %v, got %v", scenario.value, scenario.expected, components)
+		}
+	}
+}
+
+func TestComponentKey(t *testing.T) {
+	scenarios := map[string]string{
+		"[command processor] ": "command processor",
+		"command-processor":    "command processor",
+		"Command_Processor":    "command processor",
+		" [state logger]":      "state logger",
+		"heartbeat":            "heartbeat",
+	}
+
+	for name, expected := range scenarios {
+		if key := ComponentKey(name); key != expected {
+			t.Fatalf("expected %q to become %q, got %q", name, expected, key)
+		}
+	}
+}
+
+// embeddingLogger holds on to a logger the way the client's processors do, hiding its WithFields method.
+type embeddingLogger struct {
+	Logger
+}
+
+func TestComponentLevels(t *testing.T) {
+	recorder := &recordingBackend{}
+	SetBackend(recorder)
+	defer SetBackend(NewTextBackend(os.Stdout, false))
+
+	e := SetLevels(defs.WarnLogLevelTag, map[string]string{
+		"state-logger":    defs.DebugLogLevelTag,
+		"command_process": defs.ErrorLogLevelTag,
+		"not-a-component": defs.DebugLogLevelTag,
+	})
+
+	if e != nil {
+		t.Fatalf("unable to set levels: %s", e.Error())
+	}
+
+	defer SetLevels(defs.DebugLogLevelTag, nil)
+
+	state, other := New("[state logger] ", Green), New("[other] ", Green)
+	wrapped := WithFields(embeddingLogger{state}, Fields{"attempt": 1})
+
+	if _, ok := wrapped.(*suffixLogger); ok != true {
+		t.Fatalf("expected loggers without WithFields to be wrapped in a suffix logger")
+	}
+
+	state.Debugf("state debug")
+	WithFields(state, Fields{"device_id": "lobby"}).Debugf("fielded state debug")
+	wrapped.Debugf("wrapped state debug")
+	other.Infof("other info")
+	other.Warnf("other warn")
+	New("[command processor] ", Green).Warnf("partial component name")
+	SetLevels(defs.ErrorLogLevelTag, nil)
+	state.Warnf("state warn after reset")
+	other.Errorf("other error after reset")
+
+	messages := make([]string, len(recorder.entries))
+
+	for i, entry := range recorder.entries {
+		messages[i] = entry.Component + ": " + entry.Message
+	}
+
+	expected := []string{
+		"state logger: state debug",
+		"state logger: fielded state debug",
+		"state logger: wrapped state debug attempt=1",
+		"other: other warn",
+		"command processor: partial component name",
+		"other: other error after reset",
+	}
+
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q, got %q", expected, messages)
+	}
+}
@@ -1,8 +1,8 @@
 package logging
 
-import "os"
-import "log"
 import "fmt"
+import "time"
+import "strings"
 import "github.com/ttacon/chalk"
 import "github.com/dadleyy/beacon.client/beacon/defs"
 
@@ -25,13 +25,16 @@ const (
 	White
 )
 
-// New retrurns a new logger
+// New retrurns a new logger for the component named by the prefix (one of the defs.*LoggerPrefix values). Messages
+// at or above the level set for the component are written to whichever backend is configured at the time, with any
+// registered secrets masked.
 func New(name string, colorFlag uint) Logger {
-	prefix := color(colorFlag, name)
-	writer := log.New(os.Stdout, prefix, defs.DefaultLogFlags)
-	return &ColorLogger{writer}
+	return &ComponentLogger{name: name, key: ComponentKey(name), color: colorFlag}
 }
 
+// Fields are key/value pairs attached to a log message; structured backends output them alongside the message.
+type Fields map[string]interface{}
+
 // Logger defines an interface for leveled logging
 type Logger interface {
 	Errorf(string, ...interface{})
@@ -40,35 +43,85 @@ type Logger interface {
 	Infof(string, ...interface{})
 }
 
-// ColorLogger wraps the golang log.Logger struct for coloring
-type ColorLogger struct {
-	*log.Logger
+// FieldLogger is implemented by loggers that can attach fields to their messages. It is optional; WithFields falls
+// back to appending the fields to the message for loggers that do not implement it.
+type FieldLogger interface {
+	Logger
+	WithFields(Fields) Logger
+}
+
+// WithFields returns a logger attaching the fields to every message written through it.
+func WithFields(logger Logger, fields Fields) Logger {
+	if fielded, ok := logger.(FieldLogger); ok {
+		return fielded.WithFields(fields)
+	}
+
+	return &suffixLogger{logger, fields}
+}
+
+// ColorLogger is the former name of ComponentLogger.
+//
+// Deprecated: use ComponentLogger, or New to construct one.
+type ColorLogger = ComponentLogger
+
+// ComponentLogger tags every message with the component it was created for before handing it to the backend.
+type ComponentLogger struct {
+	name   string
+	key    string
+	color  uint
+	fields Fields
+}
+
+// Errorf sends the output to the backend at the error level
+func (logger *ComponentLogger) Errorf(format string, items ...interface{}) {
+	logger.write(defs.ErrorLogLevelTag, format, items...)
 }
 
-// Errorf sends the output colored
-func (logger *ColorLogger) Errorf(format string, items ...interface{}) {
-	logger.printfc(chalk.Red, defs.ErrorLogLevelTag, format, items...)
+// Warnf sends the output to the backend at the warn level
+func (logger *ComponentLogger) Warnf(format string, items ...interface{}) {
+	logger.write(defs.WarnLogLevelTag, format, items...)
 }
 
-// Warnf sends the output colored
-func (logger *ColorLogger) Warnf(format string, items ...interface{}) {
-	logger.printfc(chalk.Yellow, defs.WarnLogLevelTag, format, items...)
+// Infof sends the output to the backend at the info level
+func (logger *ComponentLogger) Infof(format string, items ...interface{}) {
+	logger.write(defs.InfoLogLevelTag, format, items...)
 }
 
-// Infof sends the output colored
-func (logger *ColorLogger) Infof(format string, items ...interface{}) {
-	logger.printfc(chalk.Cyan, defs.InfoLogLevelTag, format, items...)
+// Debugf sends the output to the backend at the debug level
+func (logger *ComponentLogger) Debugf(format string, items ...interface{}) {
+	logger.write(defs.DebugLogLevelTag, format, items...)
 }
 
-// Debugf sends the output colored
-func (logger *ColorLogger) Debugf(format string, items ...interface{}) {
-	logger.printfc(chalk.Blue, defs.DebugLogLevelTag, format, items...)
+// WithFields returns a logger for the same component that attaches the fields (in addition to its own) to every
+// message.
+func (logger *ComponentLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(logger.fields)+len(fields))
+
+	for key, value := range logger.fields {
+		merged[key] = value
+	}
+
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return &ComponentLogger{logger.name, logger.key, logger.color, merged}
 }
 
-func (logger *ColorLogger) printfc(crayon chalk.Color, label string, format string, items ...interface{}) {
-	labelTag := fmt.Sprintf("[%s]", label)
-	formatted := fmt.Sprintf("%v %s", crayon.Color(labelTag), fmt.Sprintf(format, items...))
-	logger.Printf("%s", formatted)
+func (logger *ComponentLogger) write(level string, format string, items ...interface{}) {
+	if enabled(logger.key, level) != true {
+		return
+	}
+
+	currentBackend().Write(&Entry{
+		Time:      time.Now(),
+		Level:     level,
+		Prefix:    logger.name,
+		Component: strings.Trim(logger.name, "[] "),
+		Color:     logger.color,
+		Message:   Redact(fmt.Sprintf(format, items...)),
+		Fields:    redactFields(logger.fields),
+	})
 }
 
 func color(colorFlag uint, text string) string {
@@ -95,3 +148,50 @@ func color(colorFlag uint, text string) string {
 
 	return crayon.Color(text)
 }
+
+// suffixLogger appends fields to the messages of loggers that cannot hold on to fields themselves.
+type suffixLogger struct {
+	Logger
+	fields Fields
+}
+
+func (logger *suffixLogger) Errorf(format string, items ...interface{}) {
+	logger.Logger.Errorf("%s", logger.format(format, items...))
+}
+
+func (logger *suffixLogger) Warnf(format string, items ...interface{}) {
+	logger.Logger.Warnf("%s", logger.format(format, items...))
+}
+
+func (logger *suffixLogger) Infof(format string, items ...interface{}) {
+	logger.Logger.Infof("%s", logger.format(format, items...))
+}
+
+func (logger *suffixLogger) Debugf(format string, items ...interface{}) {
+	logger.Logger.Debugf("%s", logger.format(format, items...))
+}
+
+// WithFields merges the fields with the ones already being appended.
+func (logger *suffixLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(logger.fields)+len(fields))
+
+	for key, value := range logger.fields {
+		merged[key] = value
+	}
+
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return &suffixLogger{logger.Logger, merged}
+}
+
+func (logger *suffixLogger) format(format string, items ...interface{}) string {
+	parts := []string{fmt.Sprintf(format, items...)}
+
+	for _, key := range sortedKeys(logger.fields) {
+		parts = append(parts, fmt.Sprintf("%s=%v", key, logger.fields[key]))
+	}
+
+	return strings.Join(parts, " ")
+}
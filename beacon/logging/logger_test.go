@@ -0,0 +1,74 @@
+package logging
+
+import "os"
+import "fmt"
+import "testing"
+
+// plainLogger implements nothing but the Logger interface, like loggers provided by programs embedding the client.
+type plainLogger struct {
+	messages []string
+}
+
+func (logger *plainLogger) Errorf(format string, items ...interface{}) {
+	logger.messages = append(logger.messages, "error "+fmt.Sprintf(format, items...))
+}
+
+func (logger *plainLogger) Warnf(format string, items ...interface{}) {
+	logger.messages = append(logger.messages, "warn "+fmt.Sprintf(format, items...))
+}
+
+func (logger *plainLogger) Debugf(format string, items ...interface{}) {
+	logger.messages = append(logger.messages, "debug "+fmt.Sprintf(format, items...))
+}
+
+func (logger *plainLogger) Infof(format string, items ...interface{}) {
+	logger.messages = append(logger.messages, "info "+fmt.Sprintf(format, items...))
+}
+
+// recordingBackend keeps every entry written to it.
+type recordingBackend struct {
+	entries []*Entry
+}
+
+func (recorder *recordingBackend) Write(entry *Entry) {
+	recorder.entries = append(recorder.entries, entry)
+}
+
+func TestWithFieldsAppendsFieldsForPlainLoggers(t *testing.T) {
+	plain := &plainLogger{}
+	logger := WithFields(plain, Fields{"attempt": 2})
+	logger.Infof("attempting %s", "retry")
+	WithFields(logger, Fields{"delay": "1s"}).Warnf("still waiting")
+
+	expected := []string{"info attempting retry attempt=2", "warn still waiting attempt=2 delay=1s"}
+
+	if fmt.Sprint(plain.messages) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, plain.messages)
+	}
+}
+
+func TestWithFieldsKeepsFieldsSeparateForComponentLoggers(t *testing.T) {
+	recorder := &recordingBackend{}
+	SetBackend(recorder)
+	defer SetBackend(NewTextBackend(os.Stdout, false))
+
+	var logger Logger = New("[test] ", Green)
+	WithFields(WithFields(logger, Fields{"attempt": 2}), Fields{"delay": "1s"}).Infof("attempting retry")
+
+	if len(recorder.entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(recorder.entries))
+	}
+
+	entry := recorder.entries[0]
+
+	if entry.Message != "attempting retry" || entry.Fields["attempt"] != 2 || entry.Fields["delay"] != "1s" {
+		t.Fatalf("unexpected entry: %s %v", entry.Message, entry.Fields)
+	}
+
+	// The deprecated name still refers to the same logger.
+	var deprecated *ColorLogger = logger.(*ComponentLogger)
+
+	if deprecated == nil {
+		t.Fatalf("expected ColorLogger to alias ComponentLogger")
+	}
+}
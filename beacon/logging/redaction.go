@@ -0,0 +1,102 @@
+package logging
+
+import "sort"
+import "sync"
+import "strings"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+var secrets = struct {
+	sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+	unsafe   bool
+}{values: make(map[string]bool), replacer: strings.NewReplacer()}
+
+// RegisterSecret adds a value (e.g a key, shared secret or header value) that is masked wherever it appears in a log
+// message or field. Values too short to be told apart from regular text are ignored.
+func RegisterSecret(secret string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	if len(secret) < defs.MinimumRedactedLength || secrets.values[secret] {
+		return
+	}
+
+	secrets.values[secret] = true
+	known := make([]string, 0, len(secrets.values))
+
+	for value := range secrets.values {
+		known = append(known, value)
+	}
+
+	// Longer secrets go first so that a secret containing another is masked as a whole.
+	sort.Slice(known, func(i int, j int) bool {
+		return len(known[i]) > len(known[j])
+	})
+
+	pairs := make([]string, 0, len(known)*2)
+
+	for _, value := range known {
+		pairs = append(pairs, value, defs.RedactedLogText)
+	}
+
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// SetUnsafe turns redaction off (or back on). Only meant for debugging locally; secrets end up in the logs.
+func SetUnsafe(unsafe bool) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.unsafe = unsafe
+}
+
+// Redact returns the text with every registered secret masked, unless redaction has been turned off.
+func Redact(text string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	if secrets.unsafe {
+		return text
+	}
+
+	return secrets.replacer.Replace(text)
+}
+
+// Secret wraps a value that should never be logged as it is (e.g a message digest); it formats as a mask unless
+// redaction has been turned off.
+type Secret string
+
+// String returns the mask, or the value itself in unsafe mode.
+func (secret Secret) String() string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	if secrets.unsafe {
+		return string(secret)
+	}
+
+	return defs.RedactedLogText
+}
+
+// redactFields returns a copy of the fields with the secrets in any text values masked.
+func redactFields(fields Fields) Fields {
+	if len(fields) == 0 {
+		return fields
+	}
+
+	redacted := make(Fields, len(fields))
+
+	for key, value := range fields {
+		switch text := value.(type) {
+		case string:
+			redacted[key] = Redact(text)
+		case error:
+			redacted[key] = Redact(text.Error())
+		default:
+			redacted[key] = value
+		}
+	}
+
+	return redacted
+}
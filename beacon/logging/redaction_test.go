@@ -0,0 +1,73 @@
+package logging
+
+import "fmt"
+import "testing"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+func TestRedact(t *testing.T) {
+	RegisterSecret("redacted-shared-secret")
+	RegisterSecret("short")
+	RegisterSecret("overlapping-secret")
+	RegisterSecret("overlapping-secret-longer")
+	mask := defs.RedactedLogText
+
+	scenarios := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"registered secret", "secret: redacted-shared-secret.", "secret: " + mask + "."},
+		{"every occurrence", "redacted-shared-secret/redacted-shared-secret", mask + "/" + mask},
+		{"short values are ignored", "a short message", "a short message"},
+		{"longest secret first", "overlapping-secret-longer", mask},
+		{"shorter secret on its own", "overlapping-secret!", mask + "!"},
+		{"unregistered text", "nothing to hide", "nothing to hide"},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			if redacted := Redact(scenario.text); redacted != scenario.expected {
+				t.Fatalf("expected %q, got %q", scenario.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	RegisterSecret("redacted-field-secret")
+
+	redacted := redactFields(Fields{
+		"text":   "header redacted-field-secret",
+		"error":  fmt.Errorf("rejected redacted-field-secret"),
+		"number": 12,
+	})
+
+	if redacted["text"] != "header "+defs.RedactedLogText {
+		t.Fatalf("expected text fields to be redacted, got %v", redacted["text"])
+	}
+
+	if redacted["error"] != "rejected "+defs.RedactedLogText {
+		t.Fatalf("expected error fields to be redacted, got %v", redacted["error"])
+	}
+
+	if redacted["number"] != 12 {
+		t.Fatalf("expected other fields to be left alone, got %v", redacted["number"])
+	}
+}
+
+func TestUnsafeLoggingShowsSecrets(t *testing.T) {
+	RegisterSecret("redacted-unsafe-secret")
+	digest := Secret("a-message-digest")
+
+	if Redact("redacted-unsafe-secret") != defs.RedactedLogText || digest.String() != defs.RedactedLogText {
+		t.Fatalf("expected secrets to be masked by default")
+	}
+
+	SetUnsafe(true)
+	defer SetUnsafe(false)
+
+	if Redact("redacted-unsafe-secret") != "redacted-unsafe-secret" || digest.String() != "a-message-digest" {
+		t.Fatalf("expected secrets to be shown in unsafe mode")
+	}
+}
@@ -0,0 +1,270 @@
+package logging
+
+import "io"
+import "io/ioutil"
+import "fmt"
+import "os"
+import "sort"
+import "sync"
+import "time"
+import "strings"
+import "path/filepath"
+import "compress/gzip"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+// RotationConfig controls when a RotatingFile is rotated and how many rotated files are kept.
+type RotationConfig struct {
+	// Filename is the file written to; rotated files are kept next to it with a timestamp appended to the name.
+	Filename string
+
+	// MaxSize is the size in bytes the file may grow to before it is rotated; zero disables size based rotation.
+	MaxSize int64
+
+	// MaxAge is how long the file is written to before it is rotated; zero disables age based rotation. The age is
+	// counted from when the file was created, which is kept next to it so reopening the file doesn't reset it.
+	MaxAge time.Duration
+
+	// MaxBackups is the amount of rotated files kept; zero keeps all of them.
+	MaxBackups int
+
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// NewRotatingFile returns a writer for the file described by the config. The file is opened on the first write.
+func NewRotatingFile(config RotationConfig) *RotatingFile {
+	return &RotatingFile{config: config}
+}
+
+// RotatingFile is an io.Writer appending to a file that is rotated once it grows too large or too old. The file can
+// also be reopened, for use alongside external tools (e.g logrotate) that move the file out of the way themselves.
+type RotatingFile struct {
+	sync.Mutex
+	config  RotationConfig
+	file    *os.File
+	size    int64
+	opened  time.Time
+	cleanup sync.Mutex
+}
+
+// Write appends the data to the file, rotating it first if the data would take it over its size or it is too old.
+func (writer *RotatingFile) Write(data []byte) (int, error) {
+	writer.Lock()
+	defer writer.Unlock()
+
+	if writer.file == nil {
+		if e := writer.open(); e != nil {
+			return 0, e
+		}
+	}
+
+	config := writer.config
+	tooLarge := config.MaxSize > 0 && writer.size > 0 && writer.size+int64(len(data)) > config.MaxSize
+	tooOld := config.MaxAge > 0 && time.Since(writer.opened) > config.MaxAge
+
+	if tooLarge || tooOld {
+		if e := writer.rotate(); e != nil {
+			return 0, e
+		}
+	}
+
+	amount, e := writer.file.Write(data)
+	writer.size += int64(amount)
+	return amount, e
+}
+
+// Reopen closes the file; it is opened again (or created, if it was moved) by the next write.
+func (writer *RotatingFile) Reopen() error {
+	return writer.Close()
+}
+
+// Close closes the file.
+func (writer *RotatingFile) Close() error {
+	writer.Lock()
+	defer writer.Unlock()
+
+	if writer.file == nil {
+		return nil
+	}
+
+	e := writer.file.Close()
+	writer.file = nil
+	return e
+}
+
+func (writer *RotatingFile) open() error {
+	if e := os.MkdirAll(filepath.Dir(writer.config.Filename), 0755); e != nil {
+		return e
+	}
+
+	file, e := os.OpenFile(writer.config.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if e != nil {
+		return e
+	}
+
+	info, e := file.Stat()
+
+	if e != nil {
+		file.Close()
+		return e
+	}
+
+	writer.file, writer.size, writer.opened = file, info.Size(), writer.created(info)
+	return nil
+}
+
+// created returns when the open file was created, recording the current time for files that were just created. Files
+// written before their creation time was recorded are aged from their last modification.
+func (writer *RotatingFile) created(info os.FileInfo) time.Time {
+	marker := filepath.Join(filepath.Dir(writer.config.Filename), "."+filepath.Base(writer.config.Filename)+".created")
+
+	if info.Size() == 0 {
+		now := time.Now()
+		ioutil.WriteFile(marker, []byte(now.Format(time.RFC3339Nano)), 0644)
+		return now
+	}
+
+	data, e := ioutil.ReadFile(marker)
+
+	if e != nil {
+		return info.ModTime()
+	}
+
+	created, e := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+
+	// A marker newer than the file's last write was left by some other file (e.g one moved out by logrotate).
+	if e != nil || created.After(info.ModTime()) {
+		return info.ModTime()
+	}
+
+	return created
+}
+
+// rotate moves the current file aside and opens a new one, compressing and pruning old files in the background.
+func (writer *RotatingFile) rotate() error {
+	if e := writer.file.Close(); e != nil {
+		return e
+	}
+
+	writer.file = nil
+	rotated := writer.config.Filename + "." + time.Now().Format(defs.LogRotationTimeFormat)
+
+	if e := os.Rename(writer.config.Filename, rotated); e != nil {
+		return e
+	}
+
+	go writer.compressAndPrune(rotated)
+	return writer.open()
+}
+
+func (writer *RotatingFile) compressAndPrune(rotated string) {
+	writer.cleanup.Lock()
+	defer writer.cleanup.Unlock()
+
+	if writer.config.Compress {
+		compress(rotated)
+	}
+
+	if writer.config.MaxBackups <= 0 {
+		return
+	}
+
+	backups, e := filepath.Glob(writer.config.Filename + ".*")
+
+	if e != nil {
+		return
+	}
+
+	// Rotated files are named by the time they were rotated at, so sorting them by name sorts them by age.
+	for i := range backups {
+		backups[i] = strings.TrimSuffix(backups[i], ".gz")
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	keep := writer.config.MaxBackups
+
+	if keep > len(backups) {
+		keep = len(backups)
+	}
+
+	for _, backup := range backups[keep:] {
+		os.Remove(backup)
+		os.Remove(backup + ".gz")
+	}
+}
+
+// compress replaces the file with a gzipped copy of it, leaving it as it is if that fails.
+func compress(filename string) {
+	source, e := os.Open(filename)
+
+	if e != nil {
+		return
+	}
+
+	defer source.Close()
+
+	destination, e := os.OpenFile(filename+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if e != nil {
+		return
+	}
+
+	zipper := gzip.NewWriter(destination)
+	_, e = io.Copy(zipper, source)
+
+	if closed := zipper.Close(); e == nil {
+		e = closed
+	}
+
+	if closed := destination.Close(); e == nil {
+		e = closed
+	}
+
+	if e != nil {
+		os.Remove(filename + ".gz")
+		return
+	}
+
+	os.Remove(filename)
+}
+
+// NewFileBackend returns a backend writing the format (text or json, never colored) to a rotating file, which is
+// opened before returning.
+func NewFileBackend(format string, config RotationConfig) (*FileBackend, error) {
+	if config.Filename == "" {
+		return nil, fmt.Errorf("invalid-log-file")
+	}
+
+	file := NewRotatingFile(config)
+	formatted, e := NewBackend(format, file)
+
+	if e != nil {
+		return nil, e
+	}
+
+	// Open the file right away so a file that cannot be written to is reported instead of failing every write.
+	if e := file.open(); e != nil {
+		return nil, e
+	}
+
+	return &FileBackend{Backend: formatted, file: file}, nil
+}
+
+// FileBackend writes entries to a rotating file, which is closed along with the backend.
+type FileBackend struct {
+	Backend
+	file *RotatingFile
+}
+
+// Reopen reopens the file the backend writes to.
+func (backend *FileBackend) Reopen() error {
+	return backend.file.Reopen()
+}
+
+// Close closes the file the backend writes to.
+func (backend *FileBackend) Close() error {
+	return backend.file.Close()
+}
@@ -0,0 +1,81 @@
+package logging
+
+import "os"
+import "time"
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+
+// writeAndReopen writes the line to a file rotated every hour, closing it afterwards like a reload would.
+func writeAndReopen(t *testing.T, filename string, line string) {
+	writer := NewRotatingFile(RotationConfig{Filename: filename, MaxAge: time.Hour})
+
+	if _, e := writer.Write([]byte(line)); e != nil {
+		t.Fatalf("unable to write: %s", e.Error())
+	}
+
+	if e := writer.Close(); e != nil {
+		t.Fatalf("unable to close: %s", e.Error())
+	}
+}
+
+// rotatedFiles returns the files the log was rotated into.
+func rotatedFiles(t *testing.T, filename string) []string {
+	rotated, e := filepath.Glob(filename + ".*")
+
+	if e != nil {
+		t.Fatalf("unable to list rotated files: %s", e.Error())
+	}
+
+	return rotated
+}
+
+func TestRotatingFileKeepsItsAgeAcrossReopens(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.log")
+	writeAndReopen(t, filename, "first\n")
+	writeAndReopen(t, filename, "second\n")
+
+	if rotated := rotatedFiles(t, filename); len(rotated) != 0 {
+		t.Fatalf("expected a young file to be appended to, found %v", rotated)
+	}
+
+	// Age the file as if it was created two hours ago, leaving it recently written to.
+	marker := filepath.Join(filepath.Dir(filename), ".client.log.created")
+	created := time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano)
+
+	if e := ioutil.WriteFile(marker, []byte(created), 0644); e != nil {
+		t.Fatalf("unable to age the file: %s", e.Error())
+	}
+
+	writeAndReopen(t, filename, "third\n")
+
+	if rotated := rotatedFiles(t, filename); len(rotated) != 1 {
+		t.Fatalf("expected the old file to be rotated once after reopening it, found %v", rotated)
+	}
+
+	data, e := ioutil.ReadFile(filename)
+
+	if e != nil || string(data) != "third\n" {
+		t.Fatalf("expected the new file to only contain the latest write, found %q (%v)", data, e)
+	}
+}
+
+func TestRotatingFileAgesUnmarkedFilesFromTheirLastWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.log")
+
+	if e := ioutil.WriteFile(filename, []byte("written by an older client\n"), 0644); e != nil {
+		t.Fatalf("unable to write the existing file: %s", e.Error())
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	if e := os.Chtimes(filename, old, old); e != nil {
+		t.Fatalf("unable to age the file: %s", e.Error())
+	}
+
+	writeAndReopen(t, filename, "first\n")
+
+	if rotated := rotatedFiles(t, filename); len(rotated) != 1 {
+		t.Fatalf("expected the old file to be rotated on the first write, found %v", rotated)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import "fmt"
+import "bytes"
+import "log/syslog"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+// NewSyslogBackend connects to the local syslog daemon over its unix socket, tagging messages with the identifier.
+func NewSyslogBackend(identifier string) (*SyslogBackend, error) {
+	writer, e := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, identifier)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &SyslogBackend{writer}, nil
+}
+
+// SyslogBackend writes entries to syslog at the priority matching their level. The component prefixes the message
+// and fields follow it as key=value pairs.
+type SyslogBackend struct {
+	writer *syslog.Writer
+}
+
+// Write sends the entry to syslog.
+func (backend *SyslogBackend) Write(entry *Entry) {
+	line := bytes.NewBufferString(entry.Prefix)
+	line.WriteString(entry.Message)
+
+	for _, key := range sortedKeys(entry.Fields) {
+		fmt.Fprintf(line, " %s=%v", key, entry.Fields[key])
+	}
+
+	switch entry.Level {
+	case defs.ErrorLogLevelTag:
+		backend.writer.Err(line.String())
+	case defs.WarnLogLevelTag:
+		backend.writer.Warning(line.String())
+	case defs.InfoLogLevelTag:
+		backend.writer.Info(line.String())
+	default:
+		backend.writer.Debug(line.String())
+	}
+}
+
+// Close disconnects from the syslog daemon.
+func (backend *SyslogBackend) Close() error {
+	return backend.writer.Close()
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logging
+
+import "fmt"
+
+// NewSyslogBackend is not supported on platforms without a syslog daemon.
+func NewSyslogBackend(identifier string) (Backend, error) {
+	return nil, fmt.Errorf("syslog-unsupported")
+}
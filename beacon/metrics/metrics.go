@@ -0,0 +1,103 @@
+package metrics
+
+import "net/http"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/collectors"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+
+var (
+	// MessagesReceived counts the device messages read from the api, by DeviceMessageType.
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Device messages received from the api, by message type.",
+	}, []string{"type"})
+
+	// ValidationFailures counts the messages refused by the command processor, by error category.
+	ValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "validation_failures_total",
+		Help:      "Device messages that failed validation, by reason.",
+	}, []string{"reason"})
+
+	// ControlFramesExecuted counts the control frames sent to the device.
+	ControlFramesExecuted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "control_frames_executed_total",
+		Help:      "Control frames sent to the device.",
+	})
+
+	// Preemptions counts the control messages interrupted by a newer one before they completed.
+	Preemptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "preemptions_total",
+		Help:      "Control messages preempted by a newer control message.",
+	})
+
+	// FeedbackPublished counts the attempts to publish feedback, by result.
+	FeedbackPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "feedback_published_total",
+		Help:      "Attempts to publish feedback to the api, by result (published, rejected or failed).",
+	}, []string{"result"})
+
+	// FeedbackLatency observes how long publishing each feedback message took.
+	FeedbackLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "feedback_publish_seconds",
+		Help:      "Time spent publishing feedback to the api.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// HeartbeatFailures counts the pings that could not be sent.
+	HeartbeatFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "heartbeat_failures_total",
+		Help:      "Heartbeat pings that could not be sent to the api.",
+	})
+
+	// ReconnectAttempts counts the attempts to reconnect to the api after losing the subscription.
+	ReconnectAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "reconnect_attempts_total",
+		Help:      "Attempts to reconnect to the api.",
+	})
+
+	// Connected is 1 while the subscription to the api is open, 0 otherwise.
+	Connected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: defs.MetricsNamespace,
+		Name:      "connected",
+		Help:      "Whether the subscription to the api is open (1) or not (0).",
+	})
+)
+
+// Registry holds the client metrics along with the go runtime and process metrics. A registry of our own (rather
+// than the prometheus default) keeps programs embedding the client in control of what they expose.
+var Registry = newRegistry()
+
+// Handler serves the metrics held by the registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+func newRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+
+	registry.MustRegister(
+		MessagesReceived,
+		ValidationFailures,
+		ControlFramesExecuted,
+		Preemptions,
+		FeedbackPublished,
+		FeedbackLatency,
+		HeartbeatFailures,
+		ReconnectAttempts,
+		Connected,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return registry
+}
@@ -0,0 +1,62 @@
+package beacon
+
+import "fmt"
+import "strings"
+import "encoding/hex"
+import "github.com/hink/go-blink1"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/interchange"
+
+// NewPattern builds a looping control message for the named pattern in the color given as a hex rgb string (e.g
+// "ff8800"). The "none" pattern returns nil, meaning the device should be left as it is.
+func NewPattern(name string, color string) (*interchange.ControlMessage, error) {
+	on, e := parseColor(color)
+
+	if e != nil {
+		return nil, e
+	}
+
+	off := &interchange.ControlFrame{}
+
+	switch name {
+	case defs.NonePatternName:
+		return nil, nil
+	case defs.OffPatternName:
+		return &interchange.ControlMessage{Frames: []*interchange.ControlFrame{off}}, nil
+	case defs.SolidPatternName:
+		return &interchange.ControlMessage{Frames: []*interchange.ControlFrame{on}}, nil
+	case defs.BlinkPatternName:
+		on.Duration, off.Duration = defs.PatternPeriod/2, defs.PatternPeriod/2
+	case defs.BreathePatternName:
+		on.FadeTime, off.FadeTime = defs.PatternPeriod, defs.PatternPeriod
+	default:
+		return nil, fmt.Errorf("unknown-pattern: %s", name)
+	}
+
+	return &interchange.ControlMessage{
+		Frames:     []*interchange.ControlFrame{on, off},
+		RepeatMode: interchange.ControlRepeatMode_LOOP,
+	}, nil
+}
+
+// ParseColor parses a hex rgb string (e.g "ff8800", optionally prefixed with "#") into a device state.
+func ParseColor(color string) (blink1.State, error) {
+	channels, e := hex.DecodeString(strings.TrimPrefix(color, "#"))
+
+	if e != nil || len(channels) != 3 {
+		return blink1.State{}, fmt.Errorf("invalid-color: %s", color)
+	}
+
+	return blink1.State{Red: channels[0], Green: channels[1], Blue: channels[2]}, nil
+}
+
+func parseColor(color string) (*interchange.ControlFrame, error) {
+	state, e := ParseColor(color)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &interchange.ControlFrame{Red: uint32(state.Red), Green: uint32(state.Green), Blue: uint32(state.Blue)}, nil
+}
@@ -0,0 +1,15 @@
+package beacon
+
+// ReconnectPolicy decides how long to wait between attempts to re-establish the api subscription and when to give
+// up on it entirely.
+type ReconnectPolicy struct {
+	Backoff
+
+	// MaxRetries is the amount of consecutive failed attempts allowed before giving up; zero retries forever.
+	MaxRetries uint
+}
+
+// Exhausted returns true once the given amount of consecutive attempts have been made without success.
+func (policy *ReconnectPolicy) Exhausted(attempts uint) bool {
+	return policy.MaxRetries > 0 && attempts >= policy.MaxRetries
+}
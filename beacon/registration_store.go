@@ -0,0 +1,156 @@
+package beacon
+
+import "os"
+import "fmt"
+import "io/ioutil"
+import "crypto/rsa"
+import "crypto/x509"
+import "encoding/hex"
+import "encoding/json"
+import "path/filepath"
+
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+const registrationFilename = "registration.json"
+
+const sequencesFilename = "sequences.json"
+
+// NewRegistrationStore returns a store that pins the server key in the given state directory. The approved
+// fingerprint, if any, is the fingerprint of a new server key the operator has agreed may replace the pinned one.
+func NewRegistrationStore(directory string, approvedFingerprint string) *RegistrationStore {
+	return &RegistrationStore{directory, approvedFingerprint}
+}
+
+// RegistrationStore persists the registration received in welcome messages, pinning the server key the first time
+// it is seen (trust on first use) and refusing welcome messages carrying a different key afterwards.
+type RegistrationStore struct {
+	directory           string
+	approvedFingerprint string
+}
+
+type storedRegistration struct {
+	ServerKey string `json:"server_key"`
+	DeviceID  string `json:"device_id"`
+}
+
+// Load returns the pinned registration, or nil if no server key has been pinned yet.
+func (store *RegistrationStore) Load() (*RegistrationInfo, error) {
+	data, e := ioutil.ReadFile(filepath.Join(store.directory, registrationFilename))
+
+	if os.IsNotExist(e) {
+		return nil, nil
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	stored := storedRegistration{}
+
+	if e := json.Unmarshal(data, &stored); e != nil {
+		return nil, e
+	}
+
+	keyData, e := hex.DecodeString(stored.ServerKey)
+
+	if e != nil {
+		return nil, e
+	}
+
+	public, e := x509.ParsePKIXPublicKey(keyData)
+
+	if e != nil {
+		return nil, e
+	}
+
+	serverKey, ok := public.(*rsa.PublicKey)
+
+	if ok != true {
+		return nil, fmt.Errorf("invalid-public-key")
+	}
+
+	return &RegistrationInfo{serverKey, stored.DeviceID}, nil
+}
+
+// Pin persists the registration if its server key matches the pinned key, if nothing has been pinned yet, or if the
+// operator has approved the new key's fingerprint. A different, unapproved server key is rejected.
+func (store *RegistrationStore) Pin(registration *RegistrationInfo) error {
+	pinned, e := store.Load()
+
+	if e != nil {
+		return e
+	}
+
+	fingerprint, e := security.PublicKeyFingerprint(registration.serverKey)
+
+	if e != nil {
+		return e
+	}
+
+	changed := pinned != nil && pinned.serverKey.Equal(registration.serverKey) != true
+
+	if changed && fingerprint != store.approvedFingerprint {
+		return fmt.Errorf("server-key-mismatch: received key %s differs from the pinned key", fingerprint)
+	}
+
+	keyData, e := x509.MarshalPKIXPublicKey(registration.serverKey)
+
+	if e != nil {
+		return e
+	}
+
+	data, e := json.Marshal(&storedRegistration{hex.EncodeToString(keyData), registration.deviceID})
+
+	if e != nil {
+		return e
+	}
+
+	return store.write(registrationFilename, data)
+}
+
+// LoadSequences returns the highest message sequence accepted for each device id, as last saved.
+func (store *RegistrationStore) LoadSequences() (map[string]uint64, error) {
+	sequences := make(map[string]uint64)
+	data, e := ioutil.ReadFile(filepath.Join(store.directory, sequencesFilename))
+
+	if os.IsNotExist(e) {
+		return sequences, nil
+	}
+
+	if e != nil {
+		return sequences, e
+	}
+
+	if e := json.Unmarshal(data, &sequences); e != nil {
+		return make(map[string]uint64), e
+	}
+
+	return sequences, nil
+}
+
+// SaveSequences persists the highest message sequence accepted for each device id, so that messages accepted before
+// a restart cannot be replayed after it.
+func (store *RegistrationStore) SaveSequences(sequences map[string]uint64) error {
+	data, e := json.Marshal(sequences)
+
+	if e != nil {
+		return e
+	}
+
+	return store.write(sequencesFilename, data)
+}
+
+// write atomically replaces the named file in the state directory with the data.
+func (store *RegistrationStore) write(filename string, data []byte) error {
+	if e := os.MkdirAll(store.directory, 0700); e != nil {
+		return e
+	}
+
+	temp := filepath.Join(store.directory, fmt.Sprintf(".%s.tmp", filename))
+
+	if e := ioutil.WriteFile(temp, data, 0600); e != nil {
+		return e
+	}
+
+	return os.Rename(temp, filepath.Join(store.directory, filename))
+}
@@ -0,0 +1,122 @@
+package beacon
+
+import "testing"
+import "crypto/rsa"
+import "crypto/rand"
+
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+// generateServerKey returns a new rsa key standing in for the api's key.
+func generateServerKey(t *testing.T) *rsa.PublicKey {
+	key, e := rsa.GenerateKey(rand.Reader, 1024)
+
+	if e != nil {
+		t.Fatalf("unable to generate server key: %s", e.Error())
+	}
+
+	return &key.PublicKey
+}
+
+// assertPinned fails the test unless the store has the key and device id pinned.
+func assertPinned(t *testing.T, store *RegistrationStore, key *rsa.PublicKey, deviceID string) {
+	t.Helper()
+	pinned, e := store.Load()
+
+	if e != nil || pinned == nil {
+		t.Fatalf("expected a pinned registration, got %v (%v)", pinned, e)
+	}
+
+	if pinned.serverKey.Equal(key) != true || pinned.deviceID != deviceID {
+		t.Fatalf("expected %s to be pinned with its key, got %s", deviceID, pinned.deviceID)
+	}
+}
+
+func TestRegistrationStorePinsTheFirstKey(t *testing.T) {
+	store := NewRegistrationStore(t.TempDir(), "")
+
+	if pinned, e := store.Load(); pinned != nil || e != nil {
+		t.Fatalf("expected nothing to be pinned yet, got %v (%v)", pinned, e)
+	}
+
+	key := generateServerKey(t)
+
+	if e := store.Pin(&RegistrationInfo{key, testDeviceID}); e != nil {
+		t.Fatalf("unable to pin the first key: %s", e.Error())
+	}
+
+	assertPinned(t, store, key, testDeviceID)
+}
+
+func TestRegistrationStoreAcceptsThePinnedKeyAgain(t *testing.T) {
+	store, key := NewRegistrationStore(t.TempDir(), ""), generateServerKey(t)
+
+	if e := store.Pin(&RegistrationInfo{key, testDeviceID}); e != nil {
+		t.Fatalf("unable to pin the first key: %s", e.Error())
+	}
+
+	// The device id may change between welcome messages; only the key is pinned.
+	if e := store.Pin(&RegistrationInfo{key, "renamed-device"}); e != nil {
+		t.Fatalf("expected the pinned key to be accepted again, got %s", e.Error())
+	}
+
+	assertPinned(t, store, key, "renamed-device")
+}
+
+func TestRegistrationStoreRefusesADifferentKey(t *testing.T) {
+	directory := t.TempDir()
+	store, key := NewRegistrationStore(directory, ""), generateServerKey(t)
+
+	if e := store.Pin(&RegistrationInfo{key, testDeviceID}); e != nil {
+		t.Fatalf("unable to pin the first key: %s", e.Error())
+	}
+
+	other := generateServerKey(t)
+
+	if e := store.Pin(&RegistrationInfo{other, "impostor"}); e == nil {
+		t.Fatalf("expected a different server key to be refused")
+	}
+
+	// Approving some other fingerprint does not let this key through either.
+	approved, e := security.PublicKeyFingerprint(generateServerKey(t))
+
+	if e != nil {
+		t.Fatalf("unable to fingerprint key: %s", e.Error())
+	}
+
+	if e := NewRegistrationStore(directory, approved).Pin(&RegistrationInfo{other, "impostor"}); e == nil {
+		t.Fatalf("expected a server key that was not approved to be refused")
+	}
+
+	assertPinned(t, store, key, testDeviceID)
+}
+
+func TestRegistrationStoreRepinsAnApprovedKey(t *testing.T) {
+	directory := t.TempDir()
+	key, replacement := generateServerKey(t), generateServerKey(t)
+
+	if e := NewRegistrationStore(directory, "").Pin(&RegistrationInfo{key, testDeviceID}); e != nil {
+		t.Fatalf("unable to pin the first key: %s", e.Error())
+	}
+
+	approved, e := security.PublicKeyFingerprint(replacement)
+
+	if e != nil {
+		t.Fatalf("unable to fingerprint key: %s", e.Error())
+	}
+
+	if e := NewRegistrationStore(directory, approved).Pin(&RegistrationInfo{replacement, testDeviceID}); e != nil {
+		t.Fatalf("expected the approved key to be accepted, got %s", e.Error())
+	}
+
+	// Once re-pinned, the approval is no longer needed and the previous key is the one refused.
+	store := NewRegistrationStore(directory, "")
+	assertPinned(t, store, replacement, testDeviceID)
+
+	if e := store.Pin(&RegistrationInfo{replacement, testDeviceID}); e != nil {
+		t.Fatalf("expected the re-pinned key to be accepted without approval, got %s", e.Error())
+	}
+
+	if e := store.Pin(&RegistrationInfo{key, testDeviceID}); e == nil {
+		t.Fatalf("expected the previously pinned key to be refused")
+	}
+}
@@ -1,39 +1,190 @@
 package security
 
 import "io"
+import "os"
 import "fmt"
+import "strings"
 import "io/ioutil"
+import "path/filepath"
 import "crypto"
 import "crypto/rsa"
+import "crypto/rand"
 import "crypto/x509"
+import "crypto/ecdsa"
 import "crypto/sha256"
+import "crypto/ed25519"
+import "crypto/elliptic"
 import "encoding/pem"
 import "encoding/hex"
+import "github.com/youmark/pkcs8"
 
-// DeviceKey objects contain the rsa private key used to secure communications w/ the api
+const (
+	// RSAKeyType is the name of rsa device keys.
+	RSAKeyType = "rsa"
+
+	// ECDSAKeyType is the name of elliptic curve device keys.
+	ECDSAKeyType = "ecdsa"
+
+	// Ed25519KeyType is the name of ed25519 device keys.
+	Ed25519KeyType = "ed25519"
+)
+
+// DeviceKey objects contain the private key used to secure communications w/ the api
 type DeviceKey struct {
-	*rsa.PrivateKey
+	crypto.Signer
+}
+
+// Type returns the name of the underlying key type.
+func (key *DeviceKey) Type() string {
+	switch key.Signer.(type) {
+	case *rsa.PrivateKey:
+		return RSAKeyType
+	case *ecdsa.PrivateKey:
+		return ECDSAKeyType
+	case ed25519.PrivateKey:
+		return Ed25519KeyType
+	}
+
+	return fmt.Sprintf("%T", key.Signer)
 }
 
-// SharedSecret returns the string version of the rsa public key
+// SharedSecret returns the string version of the public key
 func (key *DeviceKey) SharedSecret() (string, error) {
-	publicKeyData, e := x509.MarshalPKIXPublicKey(key.Public())
+	return sharedSecret(key.Public())
+}
+
+// Decrypt implements crypto.Decrypter. Rsa keys use rsa-oaep directly while ecdsa and ed25519 keys use the hybrid
+// scheme described by Encrypt.
+func (key *DeviceKey) Decrypt(rand io.Reader, encodedMessage []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	switch private := key.Signer.(type) {
+	case *rsa.PrivateKey:
+		return rsa.DecryptOAEP(sha256.New(), rand, private, encodedMessage, []byte(encryptionLabel))
+	case *ecdsa.PrivateKey:
+		return decryptECDSA(private, encodedMessage)
+	case ed25519.PrivateKey:
+		return decryptEd25519(private, encodedMessage)
+	}
+
+	return nil, fmt.Errorf("unsupported-key-type: %s", key.Type())
+}
+
+// Fingerprint returns a short, human friendly identifier of the public key.
+func (key *DeviceKey) Fingerprint() (string, error) {
+	return PublicKeyFingerprint(key.Public())
+}
+
+// WriteToFile persists the private key as PEM, readable only by the owner. Existing files are only replaced when
+// force is true. If a passphrase is provided the key is written as an encrypted PKCS#8 block.
+func (key *DeviceKey) WriteToFile(filename string, force bool, passphrase []byte) error {
+	block, e := key.pemBlock(passphrase)
 
 	if e != nil {
-		return "", e
+		return e
 	}
 
-	return hex.EncodeToString(publicKeyData), nil
+	if e := os.MkdirAll(filepath.Dir(filename), 0700); e != nil {
+		return e
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, e := os.OpenFile(filename, flags, 0600)
+
+	if os.IsExist(e) {
+		return fmt.Errorf("key-exists: %s", filename)
+	}
+
+	if e != nil {
+		return e
+	}
+
+	defer file.Close()
+
+	// Overwritten files keep their original mode, make sure they end up private as well.
+	if e := file.Chmod(0600); e != nil {
+		return e
+	}
+
+	return pem.Encode(file, block)
 }
 
-// Decrypt implements crypto.Decrypter
-func (key *DeviceKey) Decrypt(rand io.Reader, encodedMessage []byte, opts crypto.DecrypterOpts) ([]byte, error) {
-	decoded, err := rsa.DecryptOAEP(sha256.New(), rand, key.PrivateKey, encodedMessage, []byte("beacon"))
-	return decoded, err
+// pemBlock encodes rsa keys as PKCS#1, ecdsa keys as SEC1 and everything else (including every encrypted key) as
+// PKCS#8.
+func (key *DeviceKey) pemBlock(passphrase []byte) (*pem.Block, error) {
+	if len(passphrase) > 0 {
+		data, e := pkcs8.ConvertPrivateKeyToPKCS8(key.Signer, passphrase)
+		return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: data}, e
+	}
+
+	switch private := key.Signer.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}, nil
+	case *ecdsa.PrivateKey:
+		data, e := x509.MarshalECPrivateKey(private)
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}, e
+	}
+
+	data, e := x509.MarshalPKCS8PrivateKey(key.Signer)
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: data}, e
 }
 
-// ReadDeviceKeyFromFile returns a new device key from a filename
-func ReadDeviceKeyFromFile(filename string) (*DeviceKey, error) {
+// GenerateDeviceKey creates a new device key of the given type and size. The size is the modulus length for rsa keys
+// and the curve size for ecdsa keys; zero selects a reasonable default and it is ignored for ed25519 keys.
+func GenerateDeviceKey(keyType string, bits int) (*DeviceKey, error) {
+	switch keyType {
+	case RSAKeyType:
+		if bits == 0 {
+			bits = 2048
+		}
+
+		privateKey, e := rsa.GenerateKey(rand.Reader, bits)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return &DeviceKey{privateKey}, nil
+	case ECDSAKeyType:
+		curves := map[int]elliptic.Curve{
+			0:   elliptic.P256(),
+			256: elliptic.P256(),
+			384: elliptic.P384(),
+			521: elliptic.P521(),
+		}
+
+		curve, ok := curves[bits]
+
+		if ok != true {
+			return nil, fmt.Errorf("unsupported-curve-size: %d", bits)
+		}
+
+		privateKey, e := ecdsa.GenerateKey(curve, rand.Reader)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return &DeviceKey{privateKey}, nil
+	case Ed25519KeyType:
+		_, privateKey, e := ed25519.GenerateKey(rand.Reader)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return &DeviceKey{privateKey}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported-key-type: %s", keyType)
+}
+
+// ReadDeviceKeyFromFile returns a new device key from a filename. The passphrase is only used for encrypted keys and
+// may be nil.
+func ReadDeviceKeyFromFile(filename string, passphrase Passphrase) (*DeviceKey, error) {
 	privateKeyData, e := ioutil.ReadFile(filename)
 
 	if e != nil {
@@ -46,11 +197,116 @@ func ReadDeviceKeyFromFile(filename string) (*DeviceKey, error) {
 		return nil, fmt.Errorf("invalid-pem")
 	}
 
-	privateKey, e := x509.ParsePKCS1PrivateKey(privateBlock.Bytes)
+	return ParseDeviceKey(privateBlock, passphrase)
+}
+
+// ParseDeviceKey returns a new device key from a PKCS#1, SEC1 or PKCS#8 encoded pem block. Encrypted PKCS#8 blocks and
+// legacy encrypted PEM blocks are decrypted using the passphrase.
+func ParseDeviceKey(block *pem.Block, passphrase Passphrase) (*DeviceKey, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		secret, e := readPassphrase(passphrase)
+
+		if e != nil {
+			return nil, e
+		}
+
+		defer wipe(secret)
+		privateKey, e := pkcs8.ParsePKCS8PrivateKey(block.Bytes, secret)
+
+		if e != nil {
+			return nil, fmt.Errorf("invalid-encrypted-key (incorrect passphrase?): %s", e.Error())
+		}
+
+		return newDeviceKey(privateKey)
+	}
+
+	if x509.IsEncryptedPEMBlock(block) {
+		secret, e := readPassphrase(passphrase)
+
+		if e != nil {
+			return nil, e
+		}
+
+		defer wipe(secret)
+		data, e := x509.DecryptPEMBlock(block, secret)
+
+		if e == x509.IncorrectPasswordError {
+			return nil, fmt.Errorf("incorrect-passphrase")
+		}
+
+		if e != nil {
+			return nil, e
+		}
+
+		block = &pem.Block{Type: block.Type, Bytes: data}
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, e := x509.ParsePKCS1PrivateKey(block.Bytes)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return &DeviceKey{privateKey}, nil
+	case "EC PRIVATE KEY":
+		privateKey, e := x509.ParseECPrivateKey(block.Bytes)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return &DeviceKey{privateKey}, nil
+	case "PRIVATE KEY":
+		privateKey, e := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return newDeviceKey(privateKey)
+	}
+
+	return nil, fmt.Errorf("unsupported-pem-type: %s", block.Type)
+}
+
+func newDeviceKey(privateKey interface{}) (*DeviceKey, error) {
+	switch signer := privateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return &DeviceKey{signer.(crypto.Signer)}, nil
+	case ed25519.PrivateKey:
+		return &DeviceKey{signer}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported-key-type: %T", privateKey)
+}
+
+// sharedSecret returns the hex encoded PKIX form of the public key.
+func sharedSecret(public crypto.PublicKey) (string, error) {
+	publicKeyData, e := x509.MarshalPKIXPublicKey(public)
 
 	if e != nil {
-		return nil, e
+		return "", e
+	}
+
+	return hex.EncodeToString(publicKeyData), nil
+}
+
+// PublicKeyFingerprint returns the first eight bytes of the sha256 of the PKIX encoded public key, colon separated.
+func PublicKeyFingerprint(public crypto.PublicKey) (string, error) {
+	publicKeyData, e := x509.MarshalPKIXPublicKey(public)
+
+	if e != nil {
+		return "", e
+	}
+
+	sum := sha256.Sum256(publicKeyData)
+	parts := make([]string, 8)
+
+	for i := range parts {
+		parts[i] = hex.EncodeToString(sum[i : i+1])
 	}
 
-	return &DeviceKey{privateKey}, nil
+	return strings.Join(parts, ":"), nil
 }
@@ -0,0 +1,182 @@
+package security
+
+import "fmt"
+import "strings"
+import "testing"
+import "path/filepath"
+import "crypto/rand"
+import "crypto/x509"
+import "encoding/pem"
+
+func staticPassphrase(value string) Passphrase {
+	// Passphrases are wiped once used, every call has to hand out a fresh copy.
+	return func() ([]byte, error) {
+		return []byte(value), nil
+	}
+}
+
+func generateKey(t *testing.T, keyType string, bits int) *DeviceKey {
+	t.Helper()
+	key, e := GenerateDeviceKey(keyType, bits)
+
+	if e != nil {
+		t.Fatalf("unable to generate %s key: %s", keyType, e.Error())
+	}
+
+	return key
+}
+
+func assertSameKey(t *testing.T, expected *DeviceKey, actual *DeviceKey) {
+	t.Helper()
+	want, e := expected.Fingerprint()
+
+	if e != nil {
+		t.Fatalf("unable to fingerprint key: %s", e.Error())
+	}
+
+	got, e := actual.Fingerprint()
+
+	if e != nil {
+		t.Fatalf("unable to fingerprint key: %s", e.Error())
+	}
+
+	if want != got || expected.Type() != actual.Type() {
+		t.Fatalf("expected %s key %s, got %s key %s", expected.Type(), want, actual.Type(), got)
+	}
+}
+
+var deviceKeyScenarios = []struct {
+	keyType string
+	bits    int
+	block   string
+}{
+	{RSAKeyType, 1024, "RSA PRIVATE KEY"},
+	{ECDSAKeyType, 256, "EC PRIVATE KEY"},
+	{ECDSAKeyType, 384, "EC PRIVATE KEY"},
+	{ECDSAKeyType, 521, "EC PRIVATE KEY"},
+	{Ed25519KeyType, 0, "PRIVATE KEY"},
+}
+
+func TestDeviceKeyFileRoundTrip(t *testing.T) {
+	for _, scenario := range deviceKeyScenarios {
+		scenario := scenario
+
+		t.Run(fmt.Sprintf("%s-%d", scenario.keyType, scenario.bits), func(t *testing.T) {
+			key := generateKey(t, scenario.keyType, scenario.bits)
+			filename := filepath.Join(t.TempDir(), "device.pem")
+
+			if e := key.WriteToFile(filename, false, nil); e != nil {
+				t.Fatalf("unable to write key: %s", e.Error())
+			}
+
+			block, e := key.pemBlock(nil)
+
+			if e != nil || block.Type != scenario.block {
+				t.Fatalf("expected a %s block, got %v (%v)", scenario.block, block, e)
+			}
+
+			read, e := ReadDeviceKeyFromFile(filename, nil)
+
+			if e != nil {
+				t.Fatalf("unable to read key: %s", e.Error())
+			}
+
+			assertSameKey(t, key, read)
+
+			if e := key.WriteToFile(filename, false, nil); e == nil || strings.HasPrefix(e.Error(), "key-exists") != true {
+				t.Fatalf("expected existing key to be kept, got %v", e)
+			}
+		})
+	}
+}
+
+func TestParseDeviceKeyPKCS8(t *testing.T) {
+	for _, scenario := range deviceKeyScenarios {
+		key := generateKey(t, scenario.keyType, scenario.bits)
+		data, e := x509.MarshalPKCS8PrivateKey(key.Signer)
+
+		if e != nil {
+			t.Fatalf("unable to marshal %s key: %s", scenario.keyType, e.Error())
+		}
+
+		parsed, e := ParseDeviceKey(&pem.Block{Type: "PRIVATE KEY", Bytes: data}, nil)
+
+		if e != nil {
+			t.Fatalf("unable to parse pkcs8 %s key: %s", scenario.keyType, e.Error())
+		}
+
+		assertSameKey(t, key, parsed)
+	}
+}
+
+func TestParseDeviceKeyRejectsInvalidBlocks(t *testing.T) {
+	blocks := []*pem.Block{
+		{Type: "PUBLIC KEY", Bytes: []byte("public")},
+		{Type: "RSA PRIVATE KEY", Bytes: []byte("garbage")},
+		{Type: "EC PRIVATE KEY", Bytes: []byte("garbage")},
+		{Type: "PRIVATE KEY", Bytes: []byte("garbage")},
+	}
+
+	for _, block := range blocks {
+		if _, e := ParseDeviceKey(block, nil); e == nil {
+			t.Fatalf("expected %s block to be rejected", block.Type)
+		}
+	}
+}
+
+func TestEncryptedDeviceKeyRoundTrip(t *testing.T) {
+	for _, scenario := range deviceKeyScenarios {
+		key := generateKey(t, scenario.keyType, scenario.bits)
+		filename := filepath.Join(t.TempDir(), "device.pem")
+
+		if e := key.WriteToFile(filename, false, []byte("correct horse")); e != nil {
+			t.Fatalf("unable to write encrypted %s key: %s", scenario.keyType, e.Error())
+		}
+
+		read, e := ReadDeviceKeyFromFile(filename, staticPassphrase("correct horse"))
+
+		if e != nil {
+			t.Fatalf("unable to read encrypted %s key: %s", scenario.keyType, e.Error())
+		}
+
+		assertSameKey(t, key, read)
+
+		if _, e := ReadDeviceKeyFromFile(filename, staticPassphrase("battery staple")); e == nil {
+			t.Fatalf("expected encrypted %s key to be refused with the wrong passphrase", scenario.keyType)
+		}
+
+		_, e = ReadDeviceKeyFromFile(filename, nil)
+
+		if e == nil || strings.HasPrefix(e.Error(), "passphrase-required") != true {
+			t.Fatalf("expected encrypted %s key to require a passphrase, got %v", scenario.keyType, e)
+		}
+	}
+}
+
+func TestLegacyEncryptedDeviceKey(t *testing.T) {
+	key := generateKey(t, ECDSAKeyType, 256)
+	plain, e := key.pemBlock(nil)
+
+	if e != nil {
+		t.Fatalf("unable to encode key: %s", e.Error())
+	}
+
+	// EncryptPEMBlock is deprecated, but keys encrypted this way are still around and have to keep working.
+	block, e := x509.EncryptPEMBlock(rand.Reader, plain.Type, plain.Bytes, []byte("correct horse"), x509.PEMCipherAES256)
+
+	if e != nil {
+		t.Fatalf("unable to encrypt key: %s", e.Error())
+	}
+
+	parsed, e := ParseDeviceKey(block, staticPassphrase("correct horse"))
+
+	if e != nil {
+		t.Fatalf("unable to parse legacy encrypted key: %s", e.Error())
+	}
+
+	assertSameKey(t, key, parsed)
+
+	if _, e := ParseDeviceKey(block, staticPassphrase("battery staple")); e == nil {
+		t.Fatalf("expected legacy encrypted key to be refused with the wrong passphrase")
+	}
+}
@@ -0,0 +1,208 @@
+package security
+
+import "io"
+import "fmt"
+import "math/big"
+import "crypto"
+import "crypto/aes"
+import "crypto/rsa"
+import "crypto/rand"
+import "crypto/ecdsa"
+import "crypto/cipher"
+import "crypto/sha256"
+import "crypto/sha512"
+import "crypto/ed25519"
+import "golang.org/x/crypto/hkdf"
+import "golang.org/x/crypto/curve25519"
+
+// encryptionLabel is used as the rsa-oaep label and the hkdf info of the hybrid scheme.
+const encryptionLabel = "beacon"
+
+// Encrypt encrypts the message for the holder of the private key matching the public key. Rsa keys use rsa-oaep
+// (sha256) directly. Ecdsa and ed25519 keys, which cannot encrypt, use a hybrid scheme instead: an ephemeral key is
+// agreed with the public key (ecdh on the same curve, or x25519 using the montgomery form of the ed25519 key), the
+// shared secret is expanded with hkdf-sha256 (salted with the ephemeral public key) into an aes-256-gcm key, and the
+// result is the ephemeral public key, followed by the gcm nonce and the sealed message.
+func Encrypt(public crypto.PublicKey, message []byte) ([]byte, error) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, key, message, []byte(encryptionLabel))
+	case *ecdsa.PublicKey:
+		remote, e := key.ECDH()
+
+		if e != nil {
+			return nil, e
+		}
+
+		ephemeral, e := remote.Curve().GenerateKey(rand.Reader)
+
+		if e != nil {
+			return nil, e
+		}
+
+		shared, e := ephemeral.ECDH(remote)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return seal(shared, ephemeral.PublicKey().Bytes(), message)
+	case ed25519.PublicKey:
+		scalar := make([]byte, curve25519.ScalarSize)
+
+		if _, e := io.ReadFull(rand.Reader, scalar); e != nil {
+			return nil, e
+		}
+
+		ephemeralPublic, e := curve25519.X25519(scalar, curve25519.Basepoint)
+
+		if e != nil {
+			return nil, e
+		}
+
+		remote, e := montgomeryPublicKey(key)
+
+		if e != nil {
+			return nil, e
+		}
+
+		shared, e := curve25519.X25519(scalar, remote)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return seal(shared, ephemeralPublic, message)
+	}
+
+	return nil, fmt.Errorf("unsupported-key-type: %T", public)
+}
+
+func decryptECDSA(key *ecdsa.PrivateKey, message []byte) ([]byte, error) {
+	local, e := key.ECDH()
+
+	if e != nil {
+		return nil, e
+	}
+
+	size := len(local.PublicKey().Bytes())
+
+	if len(message) < size {
+		return nil, fmt.Errorf("invalid-ciphertext")
+	}
+
+	remote, e := local.Curve().NewPublicKey(message[:size])
+
+	if e != nil {
+		return nil, fmt.Errorf("invalid-ephemeral-key")
+	}
+
+	shared, e := local.ECDH(remote)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return open(shared, message[:size], message[size:])
+}
+
+func decryptEd25519(key ed25519.PrivateKey, message []byte) ([]byte, error) {
+	if len(message) < curve25519.PointSize {
+		return nil, fmt.Errorf("invalid-ciphertext")
+	}
+
+	// The x25519 scalar of an ed25519 key is the (clamped) first half of the sha512 of its seed.
+	digest := sha512.Sum512(key.Seed())
+	digest[0] &= 248
+	digest[31] &= 127
+	digest[31] |= 64
+
+	shared, e := curve25519.X25519(digest[:32], message[:curve25519.PointSize])
+
+	if e != nil {
+		return nil, e
+	}
+
+	return open(shared, message[:curve25519.PointSize], message[curve25519.PointSize:])
+}
+
+func seal(shared []byte, ephemeralPublic []byte, message []byte) ([]byte, error) {
+	aead, e := hybridCipher(shared, ephemeralPublic)
+
+	if e != nil {
+		return nil, e
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, e := io.ReadFull(rand.Reader, nonce); e != nil {
+		return nil, e
+	}
+
+	result := append(append([]byte{}, ephemeralPublic...), nonce...)
+	return aead.Seal(result, nonce, message, nil), nil
+}
+
+func open(shared []byte, ephemeralPublic []byte, sealed []byte) ([]byte, error) {
+	aead, e := hybridCipher(shared, ephemeralPublic)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid-ciphertext")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func hybridCipher(shared []byte, ephemeralPublic []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+
+	if _, e := io.ReadFull(hkdf.New(sha256.New, shared, ephemeralPublic, []byte(encryptionLabel)), key); e != nil {
+		return nil, e
+	}
+
+	block, e := aes.NewCipher(key)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// montgomeryPublicKey converts the edwards y coordinate of an ed25519 public key into the montgomery u coordinate
+// used by x25519: u = (1 + y) / (1 - y) mod 2^255 - 19.
+func montgomeryPublicKey(key ed25519.PublicKey) ([]byte, error) {
+	prime := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	encoded := make([]byte, len(key))
+
+	// Keys are little-endian with the sign of x in the top bit; big.Int wants big-endian.
+	for i, b := range key {
+		encoded[len(key)-1-i] = b
+	}
+
+	encoded[0] &= 127
+	y := new(big.Int).SetBytes(encoded)
+	numerator := new(big.Int).Add(big.NewInt(1), y)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, prime)
+
+	// y = 1 is the identity point, which has no montgomery form to agree a key with.
+	if denominator.ModInverse(denominator, prime) == nil {
+		return nil, fmt.Errorf("invalid-public-key")
+	}
+
+	u := numerator.Mul(numerator, denominator)
+	u.Mod(u, prime)
+
+	result, data := make([]byte, curve25519.PointSize), u.Bytes()
+
+	for i, b := range data {
+		result[len(data)-1-i] = b
+	}
+
+	return result, nil
+}
@@ -0,0 +1,113 @@
+package security
+
+import "bytes"
+import "testing"
+import "crypto/rand"
+import "crypto/ecdsa"
+import "crypto/ed25519"
+import "crypto/elliptic"
+
+func TestEncryptRoundTrip(t *testing.T) {
+	message := []byte("a digest, or anything else short enough")
+
+	for _, scenario := range deviceKeyScenarios {
+		key := generateKey(t, scenario.keyType, scenario.bits)
+		encrypted, e := Encrypt(key.Public(), message)
+
+		if e != nil {
+			t.Fatalf("unable to encrypt for %s-%d key: %s", scenario.keyType, scenario.bits, e.Error())
+		}
+
+		decrypted, e := key.Decrypt(rand.Reader, encrypted, nil)
+
+		if e != nil {
+			t.Fatalf("unable to decrypt with %s-%d key: %s", scenario.keyType, scenario.bits, e.Error())
+		}
+
+		if bytes.Equal(decrypted, message) != true {
+			t.Fatalf("unexpected message from %s-%d key: %q", scenario.keyType, scenario.bits, decrypted)
+		}
+
+		again, e := Encrypt(key.Public(), message)
+
+		if e != nil || bytes.Equal(again, encrypted) {
+			t.Fatalf("expected every encryption with %s-%d key to be randomized", scenario.keyType, scenario.bits)
+		}
+	}
+}
+
+func TestDecryptRejectsTamperedCiphertext(t *testing.T) {
+	message := []byte("a digest")
+
+	for _, scenario := range deviceKeyScenarios {
+		key := generateKey(t, scenario.keyType, scenario.bits)
+		encrypted, e := Encrypt(key.Public(), message)
+
+		if e != nil {
+			t.Fatalf("unable to encrypt for %s key: %s", scenario.keyType, e.Error())
+		}
+
+		// Flip a bit at the start (the ephemeral key for the hybrid scheme), in the middle and at the end (the tag).
+		for _, position := range []int{1, len(encrypted) / 2, len(encrypted) - 1} {
+			tampered := append([]byte{}, encrypted...)
+			tampered[position] ^= 1
+
+			if _, e := key.Decrypt(rand.Reader, tampered, nil); e == nil {
+				t.Fatalf("%s key decrypted ciphertext tampered at byte %d", scenario.keyType, position)
+			}
+		}
+
+		if _, e := key.Decrypt(rand.Reader, encrypted[:len(encrypted)/3], nil); e == nil {
+			t.Fatalf("%s key decrypted truncated ciphertext", scenario.keyType)
+		}
+
+		other := generateKey(t, scenario.keyType, scenario.bits)
+
+		if _, e := other.Decrypt(rand.Reader, encrypted, nil); e == nil {
+			t.Fatalf("%s key decrypted ciphertext meant for another key", scenario.keyType)
+		}
+	}
+}
+
+func TestDecryptAcceptsCiphertextAgreedWithTheCurvePoints(t *testing.T) {
+	message := []byte("a digest")
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		key, e := ecdsa.GenerateKey(curve, rand.Reader)
+
+		if e != nil {
+			t.Fatalf("unable to generate %s key: %s", curve.Params().Name, e.Error())
+		}
+
+		ephemeral, e := ecdsa.GenerateKey(curve, rand.Reader)
+
+		if e != nil {
+			t.Fatalf("unable to generate %s ephemeral key: %s", curve.Params().Name, e.Error())
+		}
+
+		// The scheme as servers implement it: the shared secret is the padded x coordinate of the agreed point.
+		x, _ := curve.ScalarMult(key.X, key.Y, ephemeral.D.Bytes())
+		shared := make([]byte, (curve.Params().BitSize+7)/8)
+		x.FillBytes(shared)
+		encrypted, e := seal(shared, elliptic.Marshal(curve, ephemeral.X, ephemeral.Y), message)
+
+		if e != nil {
+			t.Fatalf("unable to seal for %s key: %s", curve.Params().Name, e.Error())
+		}
+
+		decrypted, e := decryptECDSA(key, encrypted)
+
+		if e != nil || bytes.Equal(decrypted, message) != true {
+			t.Fatalf("unable to decrypt for %s key: %q (%v)", curve.Params().Name, decrypted, e)
+		}
+	}
+}
+
+func TestEncryptRejectsTheIdentityEd25519Key(t *testing.T) {
+	identity := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	identity[0] = 1
+
+	if _, e := Encrypt(identity, []byte("a digest")); e == nil {
+		t.Fatalf("expected encrypting for the identity point to fail")
+	}
+}
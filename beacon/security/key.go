@@ -0,0 +1,25 @@
+package security
+
+import "io"
+import "crypto"
+import "strings"
+
+// Key is implemented by every source of device keys; keys read from files (DeviceKey) and keys that live on a
+// PKCS#11 token (TokenKey).
+type Key interface {
+	crypto.Signer
+	Decrypt(io.Reader, []byte, crypto.DecrypterOpts) ([]byte, error)
+	SharedSecret() (string, error)
+	Fingerprint() (string, error)
+	Type() string
+}
+
+// OpenDeviceKey returns the key at the location, which is either a PKCS#11 uri (see OpenTokenKey) or the filename of
+// a PEM encoded private key.
+func OpenDeviceKey(location string, passphrase Passphrase) (Key, error) {
+	if strings.HasPrefix(location, TokenKeyScheme) {
+		return OpenTokenKey(location, passphrase)
+	}
+
+	return ReadDeviceKeyFromFile(location, passphrase)
+}
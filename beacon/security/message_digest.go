@@ -0,0 +1,24 @@
+package security
+
+import "crypto/sha256"
+import "encoding/binary"
+
+// MessageDigest returns the sha256 hash that binds a message payload to its type, the device it was sent to and its
+// position in time. The hash is computed over the big-endian message type, the big-endian length of the device id,
+// the device id, the big-endian sequence, the big-endian issued-at timestamp and finally the payload itself.
+func MessageDigest(messageType uint32, deviceID string, sequence uint64, issuedAt int64, payload []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], messageType)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(deviceID)))
+
+	timing := make([]byte, 16)
+	binary.BigEndian.PutUint64(timing[0:8], sequence)
+	binary.BigEndian.PutUint64(timing[8:16], uint64(issuedAt))
+
+	s := sha256.New()
+	s.Write(header)
+	s.Write([]byte(deviceID))
+	s.Write(timing)
+	s.Write(payload)
+	return s.Sum(nil)
+}
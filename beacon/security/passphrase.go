@@ -0,0 +1,82 @@
+package security
+
+import "os"
+import "fmt"
+import "bytes"
+import "io/ioutil"
+import "golang.org/x/crypto/ssh/terminal"
+
+// Passphrase returns the passphrase used to decrypt an encrypted private key. It is only called when the key being
+// read is actually encrypted, so interactive sources will not prompt for plain keys.
+type Passphrase func() ([]byte, error)
+
+// PassphraseFromEnv reads the passphrase from the named environment variable.
+func PassphraseFromEnv(name string) Passphrase {
+	return func() ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+
+		if ok != true {
+			return nil, fmt.Errorf("passphrase-missing: $%s is not set", name)
+		}
+
+		return []byte(value), nil
+	}
+}
+
+// PassphraseFromFile reads the passphrase from the first line of the file.
+func PassphraseFromFile(filename string) Passphrase {
+	return func() ([]byte, error) {
+		data, e := ioutil.ReadFile(filename)
+
+		if e != nil {
+			return nil, e
+		}
+
+		if end := bytes.IndexAny(data, "\r\n"); end >= 0 {
+			data = data[:end]
+		}
+
+		return data, nil
+	}
+}
+
+// PassphraseFromTerminal prompts for the passphrase on stderr, reading it from stdin with echo disabled.
+func PassphraseFromTerminal(prompt string) Passphrase {
+	return func() ([]byte, error) {
+		descriptor := int(os.Stdin.Fd())
+
+		if terminal.IsTerminal(descriptor) != true {
+			return nil, fmt.Errorf("passphrase-missing: stdin is not a terminal")
+		}
+
+		fmt.Fprint(os.Stderr, prompt)
+		defer fmt.Fprintln(os.Stderr)
+		return terminal.ReadPassword(descriptor)
+	}
+}
+
+// readPassphrase calls the passphrase source, failing clearly when there is none.
+func readPassphrase(passphrase Passphrase) ([]byte, error) {
+	if passphrase == nil {
+		return nil, fmt.Errorf("passphrase-required: key is encrypted")
+	}
+
+	secret, e := passphrase()
+
+	if e != nil {
+		return nil, e
+	}
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("passphrase-required: empty passphrase")
+	}
+
+	return secret, nil
+}
+
+// wipe zeroes the passphrase once it is no longer needed.
+func wipe(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
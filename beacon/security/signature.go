@@ -0,0 +1,38 @@
+package security
+
+import "io"
+import "fmt"
+import "crypto"
+import "crypto/rsa"
+import "crypto/ecdsa"
+import "crypto/ed25519"
+
+const (
+	// RSAPSSSignature identifies signatures made using RSA-PSS over a sha256 digest.
+	RSAPSSSignature = "rsa-pss-sha256"
+
+	// ECDSASignature identifies asn.1 encoded ecdsa signatures over a sha256 digest.
+	ECDSASignature = "ecdsa-sha256"
+
+	// Ed25519Signature identifies signatures made using Ed25519.
+	Ed25519Signature = "ed25519"
+)
+
+// Sign signs the sha256 digest with the signer, picking the signature scheme based on the type of its public key.
+// The name of the scheme that was used is returned alongside the signature.
+func Sign(rand io.Reader, signer crypto.Signer, digest []byte) ([]byte, string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		signature, e := signer.Sign(rand, digest, options)
+		return signature, RSAPSSSignature, e
+	case *ecdsa.PublicKey:
+		signature, e := signer.Sign(rand, digest, crypto.SHA256)
+		return signature, ECDSASignature, e
+	case ed25519.PublicKey:
+		signature, e := signer.Sign(rand, digest, crypto.Hash(0))
+		return signature, Ed25519Signature, e
+	}
+
+	return nil, "", fmt.Errorf("unsupported-signer: %T", signer.Public())
+}
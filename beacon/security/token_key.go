@@ -0,0 +1,492 @@
+package security
+
+import "io"
+import "fmt"
+import "sync"
+import "strings"
+import "net/url"
+import "math/big"
+import "io/ioutil"
+import "crypto"
+import "crypto/rsa"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "encoding/asn1"
+import "github.com/miekg/pkcs11"
+
+import "github.com/dadleyy/beacon.client/beacon/logging"
+
+// TokenKeyScheme is the uri scheme used to select a key stored on a PKCS#11 token.
+const TokenKeyScheme = "pkcs11:"
+
+// TokenKey is a device key that lives on a PKCS#11 token (e.g a hsm, smart card or SoftHSM). Signing and decryption
+// happen inside the token; the private key is never loaded into process memory.
+type TokenKey struct {
+	context *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	private pkcs11.ObjectHandle
+	public  crypto.PublicKey
+	lock    sync.Mutex
+}
+
+// tokenKeyURI holds the parts of a RFC 7512 PKCS#11 uri that are used to locate a key.
+type tokenKeyURI struct {
+	modulePath string
+	token      string
+	object     string
+	id         []byte
+	pin        string
+	pinSource  string
+}
+
+// OpenTokenKey logs into the token described by the PKCS#11 uri and finds the private key on it, e.g:
+//
+//	pkcs11:token=beacon;object=device?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=/etc/beacon/pin
+//
+// When the uri includes neither a pin-value nor a pin-source the pin is read from the passphrase source.
+func OpenTokenKey(uri string, passphrase Passphrase) (*TokenKey, error) {
+	location, e := parseTokenKeyURI(uri)
+
+	if e != nil {
+		return nil, e
+	}
+
+	pin, e := location.readPin(passphrase)
+
+	if e != nil {
+		return nil, e
+	}
+
+	context := pkcs11.New(location.modulePath)
+
+	if context == nil {
+		return nil, fmt.Errorf("invalid-pkcs11-module: %s", location.modulePath)
+	}
+
+	if e := context.Initialize(); e != nil {
+		context.Destroy()
+		return nil, e
+	}
+
+	key := &TokenKey{context: context}
+
+	if e := key.open(location, pin); e != nil {
+		key.Close()
+		return nil, e
+	}
+
+	return key, nil
+}
+
+// Public implements crypto.Signer and crypto.Decrypter
+func (key *TokenKey) Public() crypto.PublicKey {
+	return key.public
+}
+
+// SharedSecret returns the string version of the public key
+func (key *TokenKey) SharedSecret() (string, error) {
+	return sharedSecret(key.public)
+}
+
+// Fingerprint returns a short, human friendly identifier of the public key.
+func (key *TokenKey) Fingerprint() (string, error) {
+	return PublicKeyFingerprint(key.public)
+}
+
+// Type returns the name of the key type.
+func (key *TokenKey) Type() string {
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		return RSAKeyType
+	case *ecdsa.PublicKey:
+		return ECDSAKeyType
+	}
+
+	return fmt.Sprintf("%T", key.public)
+}
+
+// Sign implements crypto.Signer; rsa keys sign using PSS when given *rsa.PSSOptions and PKCS#1 v1.5 otherwise.
+func (key *TokenKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key.lock.Lock()
+	defer key.lock.Unlock()
+
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		if opts.HashFunc() != crypto.SHA256 {
+			return nil, fmt.Errorf("unsupported-hash: %v", opts.HashFunc())
+		}
+
+		if pss, ok := opts.(*rsa.PSSOptions); ok && pss.SaltLength == rsa.PSSSaltLengthEqualsHash {
+			params := pkcs11.NewPSSParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, uint(len(digest)))
+			return key.sign(pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), digest)
+		}
+
+		// CKM_RSA_PKCS expects the digest to already be wrapped in its DigestInfo structure.
+		prefix := []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05,
+			0x00, 0x04, 0x20}
+		return key.sign(pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), append(prefix, digest...))
+	case *ecdsa.PublicKey:
+		raw, e := key.sign(pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return asn1Signature(raw)
+	}
+
+	return nil, fmt.Errorf("unsupported-key-type: %s", key.Type())
+}
+
+// Decrypt implements crypto.Decrypter using the same schemes as DeviceKey: rsa-oaep for rsa keys and the hybrid
+// scheme (with the ecdh agreement performed by the token) for ecdsa keys.
+func (key *TokenKey) Decrypt(rand io.Reader, message []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	key.lock.Lock()
+	defer key.lock.Unlock()
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		params := pkcs11.NewOAEPParams(
+			pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, []byte(encryptionLabel),
+		)
+		mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+
+		if e := key.context.DecryptInit(key.session, mechanism, key.private); e != nil {
+			return nil, e
+		}
+
+		return key.context.Decrypt(key.session, message)
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+
+		if len(message) < 1+2*size {
+			return nil, fmt.Errorf("invalid-ciphertext")
+		}
+
+		ephemeral := message[:1+2*size]
+		shared, e := key.agree(ephemeral, size)
+
+		if e != nil {
+			return nil, e
+		}
+
+		return open(shared, ephemeral, message[1+2*size:])
+	}
+
+	return nil, fmt.Errorf("unsupported-key-type: %s", key.Type())
+}
+
+// Close logs out of the token and releases the PKCS#11 module.
+func (key *TokenKey) Close() error {
+	if key.session != 0 {
+		key.context.Logout(key.session)
+		key.context.CloseSession(key.session)
+	}
+
+	key.context.Finalize()
+	key.context.Destroy()
+	return nil
+}
+
+func (key *TokenKey) open(location *tokenKeyURI, pin string) error {
+	slots, e := key.context.GetSlotList(true)
+
+	if e != nil {
+		return e
+	}
+
+	for _, slot := range slots {
+		info, e := key.context.GetTokenInfo(slot)
+
+		if e != nil || (location.token != "" && strings.TrimSpace(info.Label) != location.token) {
+			continue
+		}
+
+		if key.session, e = key.context.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); e != nil {
+			return e
+		}
+
+		if e := key.context.Login(key.session, pkcs11.CKU_USER, pin); e != nil {
+			if code, ok := e.(pkcs11.Error); ok != true || code != pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+				return e
+			}
+		}
+
+		if key.private, e = key.find(pkcs11.CKO_PRIVATE_KEY, location); e != nil {
+			return e
+		}
+
+		public, e := key.find(pkcs11.CKO_PUBLIC_KEY, location)
+
+		if e != nil {
+			return e
+		}
+
+		key.public, e = key.readPublicKey(public)
+		return e
+	}
+
+	return fmt.Errorf("token-not-found: %s", location.token)
+}
+
+func (key *TokenKey) find(class uint, location *tokenKeyURI) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+
+	if location.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, location.object))
+	}
+
+	if len(location.id) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, location.id))
+	}
+
+	if e := key.context.FindObjectsInit(key.session, template); e != nil {
+		return 0, e
+	}
+
+	defer key.context.FindObjectsFinal(key.session)
+	objects, _, e := key.context.FindObjects(key.session, 2)
+
+	if e != nil {
+		return 0, e
+	}
+
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("key-not-found: expected one object matching %s, found %d", location.object, len(objects))
+	}
+
+	return objects[0], nil
+}
+
+func (key *TokenKey) readPublicKey(object pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attributes, e := key.context.GetAttributeValue(key.session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+
+	if e != nil {
+		return nil, e
+	}
+
+	switch keyType := attributeUint(attributes[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		attributes, e := key.context.GetAttributeValue(key.session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+
+		if e != nil {
+			return nil, e
+		}
+
+		modulus, exponent := new(big.Int).SetBytes(attributes[0].Value), new(big.Int).SetBytes(attributes[1].Value)
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	case pkcs11.CKK_EC:
+		attributes, e := key.context.GetAttributeValue(key.session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+
+		if e != nil {
+			return nil, e
+		}
+
+		curve, e := namedCurve(attributes[0].Value)
+
+		if e != nil {
+			return nil, e
+		}
+
+		var point []byte
+
+		if _, e := asn1.Unmarshal(attributes[1].Value, &point); e != nil {
+			return nil, e
+		}
+
+		x, y := elliptic.Unmarshal(curve, point)
+
+		if x == nil {
+			return nil, fmt.Errorf("invalid-ec-point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported-key-type: pkcs11 key type %d", keyType)
+	}
+}
+
+func (key *TokenKey) sign(mechanism *pkcs11.Mechanism, data []byte) ([]byte, error) {
+	if e := key.context.SignInit(key.session, []*pkcs11.Mechanism{mechanism}, key.private); e != nil {
+		return nil, e
+	}
+
+	return key.context.Sign(key.session, data)
+}
+
+// agree performs the ecdh agreement with the ephemeral public key inside the token. Only the resulting shared secret,
+// which is a throwaway session object, is extracted.
+func (key *TokenKey) agree(ephemeral []byte, size int) ([]byte, error) {
+	params := pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, ephemeral)
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, params)}
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, size),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+
+	derived, e := key.context.DeriveKey(key.session, mechanism, key.private, template)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer key.context.DestroyObject(key.session, derived)
+	attributes, e := key.context.GetAttributeValue(key.session, derived, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+
+	if e != nil {
+		return nil, e
+	}
+
+	return attributes[0].Value, nil
+}
+
+func parseTokenKeyURI(uri string) (*tokenKeyURI, error) {
+	if strings.HasPrefix(uri, TokenKeyScheme) != true {
+		return nil, fmt.Errorf("invalid-pkcs11-uri: missing %s scheme", TokenKeyScheme)
+	}
+
+	path, query := strings.TrimPrefix(uri, TokenKeyScheme), ""
+
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
+	location := &tokenKeyURI{}
+
+	for _, attribute := range strings.Split(path, ";") {
+		parts := strings.SplitN(attribute, "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		value, e := url.PathUnescape(parts[1])
+
+		if e != nil {
+			return nil, e
+		}
+
+		switch parts[0] {
+		case "token":
+			location.token = value
+		case "object":
+			location.object = value
+		case "id":
+			location.id = []byte(value)
+		}
+	}
+
+	values, e := url.ParseQuery(query)
+
+	if e != nil {
+		return nil, e
+	}
+
+	location.modulePath = values.Get("module-path")
+	location.pin = values.Get("pin-value")
+	location.pinSource = values.Get("pin-source")
+
+	if location.modulePath == "" {
+		return nil, fmt.Errorf("invalid-pkcs11-uri: missing module-path")
+	}
+
+	if location.object == "" && len(location.id) == 0 {
+		return nil, fmt.Errorf("invalid-pkcs11-uri: missing object or id")
+	}
+
+	return location, nil
+}
+
+// readPin returns the pin given by the uri, read from the pin source or the passphrase (in that order). The pin is
+// registered as a secret, keeping it out of the logs along with any uri carrying it.
+func (location *tokenKeyURI) readPin(passphrase Passphrase) (pin string, e error) {
+	defer func() {
+		if e == nil {
+			logging.RegisterSecret(pin)
+		}
+	}()
+
+	if location.pin != "" {
+		return location.pin, nil
+	}
+
+	if location.pinSource != "" {
+		data, e := ioutil.ReadFile(strings.TrimPrefix(location.pinSource, "file:"))
+
+		if e != nil {
+			return "", e
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	secret, e := readPassphrase(passphrase)
+
+	if e != nil {
+		return "", e
+	}
+
+	defer wipe(secret)
+	return string(secret), nil
+}
+
+// asn1Signature converts the raw r || s ecdsa signature returned by tokens into the asn.1 encoding go expects.
+func asn1Signature(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("invalid-signature-length: %d", len(raw))
+	}
+
+	half := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(raw[:half]),
+		new(big.Int).SetBytes(raw[half:]),
+	})
+}
+
+// namedCurve maps the DER encoded curve oid from CKA_EC_PARAMS onto the go curve.
+func namedCurve(params []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+
+	if _, e := asn1.Unmarshal(params, &oid); e != nil {
+		return nil, e
+	}
+
+	curves := map[string]elliptic.Curve{
+		"1.2.840.10045.3.1.7": elliptic.P256(),
+		"1.3.132.0.34":        elliptic.P384(),
+		"1.3.132.0.35":        elliptic.P521(),
+	}
+
+	curve, ok := curves[oid.String()]
+
+	if ok != true {
+		return nil, fmt.Errorf("unsupported-curve: %s", oid.String())
+	}
+
+	return curve, nil
+}
+
+// attributeUint decodes a CK_ULONG attribute value, which tokens return in native (little-endian) byte order.
+func attributeUint(value []byte) uint {
+	result := uint(0)
+
+	for i := len(value) - 1; i >= 0; i-- {
+		result = result<<8 | uint(value[i])
+	}
+
+	return result
+}
@@ -0,0 +1,416 @@
+package security
+
+import "os"
+import "fmt"
+import "bytes"
+import "strings"
+import "testing"
+import "math/big"
+import "io/ioutil"
+import "path/filepath"
+import "crypto"
+import "crypto/rsa"
+import "crypto/rand"
+import "crypto/ecdsa"
+import "crypto/sha256"
+import "crypto/elliptic"
+import "encoding/asn1"
+import "github.com/miekg/pkcs11"
+
+import "github.com/dadleyy/beacon.client/beacon/logging"
+
+// softHSMModuleEnvVariable names the SoftHSM module used by the token tests, which are skipped when it is not set.
+const softHSMModuleEnvVariable = "BEACON_SOFTHSM_MODULE"
+
+func TestParseTokenKeyURI(t *testing.T) {
+	location, e := parseTokenKeyURI(
+		"pkcs11:token=beacon%20device;object=device;id=%01%02?module-path=/lib/softhsm.so&pin-source=file:/etc/pin",
+	)
+
+	if e != nil {
+		t.Fatalf("unable to parse uri: %s", e.Error())
+	}
+
+	expected := &tokenKeyURI{
+		modulePath: "/lib/softhsm.so",
+		token:      "beacon device",
+		object:     "device",
+		id:         []byte{1, 2},
+		pinSource:  "file:/etc/pin",
+	}
+
+	if fmt.Sprintf("%#v", location) != fmt.Sprintf("%#v", expected) {
+		t.Fatalf("expected %#v, got %#v", expected, location)
+	}
+
+	invalid := []string{
+		"/keys/device.pem",
+		"pkcs11:object=device",
+		"pkcs11:token=beacon?module-path=/lib/softhsm.so",
+		"pkcs11:object=%zz?module-path=/lib/softhsm.so",
+		"pkcs11:object=device?module-path=%zz",
+	}
+
+	for _, uri := range invalid {
+		if _, e := parseTokenKeyURI(uri); e == nil {
+			t.Fatalf("expected %s to be rejected", uri)
+		}
+	}
+}
+
+func TestTokenKeyPin(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+
+	if e := ioutil.WriteFile(pinFile, []byte("1234\n"), 0600); e != nil {
+		t.Fatalf("unable to write pin: %s", e.Error())
+	}
+
+	scenarios := []struct {
+		uri        string
+		passphrase Passphrase
+		pin        string
+	}{
+		{"pkcs11:object=device?module-path=m&pin-value=5678", nil, "5678"},
+		{"pkcs11:object=device?module-path=m&pin-source=file:" + pinFile, nil, "1234"},
+		{"pkcs11:object=device?module-path=m&pin-source=" + pinFile, nil, "1234"},
+		{"pkcs11:object=device?module-path=m", staticPassphrase("4321"), "4321"},
+	}
+
+	for _, scenario := range scenarios {
+		location, e := parseTokenKeyURI(scenario.uri)
+
+		if e != nil {
+			t.Fatalf("unable to parse %s: %s", scenario.uri, e.Error())
+		}
+
+		pin, e := location.readPin(scenario.passphrase)
+
+		if e != nil || pin != scenario.pin {
+			t.Fatalf("expected pin %s for %s, got %s (%v)", scenario.pin, scenario.uri, pin, e)
+		}
+	}
+
+	location, _ := parseTokenKeyURI("pkcs11:object=device?module-path=m")
+
+	if _, e := location.readPin(nil); e == nil {
+		t.Fatalf("expected a missing pin to be an error")
+	}
+}
+
+func TestTokenKeyPinIsRedacted(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+
+	if e := ioutil.WriteFile(pinFile, []byte("pin-from-source\n"), 0600); e != nil {
+		t.Fatalf("unable to write pin: %s", e.Error())
+	}
+
+	scenarios := []struct {
+		uri        string
+		passphrase Passphrase
+		pin        string
+	}{
+		{"pkcs11:object=device?module-path=m&pin-value=pin-from-value", nil, "pin-from-value"},
+		{"pkcs11:object=device?module-path=m&pin-source=" + pinFile, nil, "pin-from-source"},
+		{"pkcs11:object=device?module-path=m", staticPassphrase("pin-from-passphrase"), "pin-from-passphrase"},
+	}
+
+	for _, scenario := range scenarios {
+		location, e := parseTokenKeyURI(scenario.uri)
+
+		if e != nil {
+			t.Fatalf("unable to parse %s: %s", scenario.uri, e.Error())
+		}
+
+		if _, e := location.readPin(scenario.passphrase); e != nil {
+			t.Fatalf("unable to read pin from %s: %s", scenario.uri, e.Error())
+		}
+
+		redacted := logging.Redact("opening " + scenario.uri + " with " + scenario.pin)
+
+		if strings.Contains(redacted, scenario.pin) {
+			t.Fatalf("expected the pin to be masked, got %s", redacted)
+		}
+	}
+}
+
+func TestASN1Signature(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		private, e := ecdsa.GenerateKey(curve, rand.Reader)
+
+		if e != nil {
+			t.Fatalf("unable to generate key: %s", e.Error())
+		}
+
+		digest := sha256.Sum256([]byte("message"))
+		r, s, e := ecdsa.Sign(rand.Reader, private, digest[:])
+
+		if e != nil {
+			t.Fatalf("unable to sign: %s", e.Error())
+		}
+
+		// Tokens left pad both values to the size of the curve.
+		size := (curve.Params().BitSize + 7) / 8
+		raw := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		signature, e := asn1Signature(raw)
+
+		if e != nil {
+			t.Fatalf("unable to convert signature: %s", e.Error())
+		}
+
+		if ecdsa.VerifyASN1(&private.PublicKey, digest[:], signature) != true {
+			t.Fatalf("converted %s signature does not verify", curve.Params().Name)
+		}
+
+		var decoded struct{ R, S *big.Int }
+
+		if _, e := asn1.Unmarshal(signature, &decoded); e != nil || decoded.R.Cmp(r) != 0 || decoded.S.Cmp(s) != 0 {
+			t.Fatalf("converted %s signature does not hold the original values", curve.Params().Name)
+		}
+	}
+
+	for _, raw := range [][]byte{nil, {1, 2, 3}} {
+		if _, e := asn1Signature(raw); e == nil {
+			t.Fatalf("expected %d byte signature to be rejected", len(raw))
+		}
+	}
+}
+
+func TestNamedCurve(t *testing.T) {
+	params, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 34})
+
+	if curve, e := namedCurve(params); e != nil || curve != elliptic.P384() {
+		t.Fatalf("expected P-384, got %v (%v)", curve, e)
+	}
+
+	unknown, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10})
+
+	if _, e := namedCurve(unknown); e == nil {
+		t.Fatalf("expected unsupported curves to be rejected")
+	}
+
+	if value := attributeUint([]byte{0x01, 0x02, 0, 0, 0, 0, 0, 0}); value != 0x0201 {
+		t.Fatalf("expected little-endian attribute, got %x", value)
+	}
+}
+
+// softHSMToken initializes a fresh SoftHSM token holding an rsa and an ecdsa key pair, returning the module path.
+func softHSMToken(t *testing.T) string {
+	t.Helper()
+	module := os.Getenv(softHSMModuleEnvVariable)
+
+	if module == "" {
+		t.Skipf("set $%s to the SoftHSM module to run the token tests", softHSMModuleEnvVariable)
+	}
+
+	directory := t.TempDir()
+	config := filepath.Join(directory, "softhsm2.conf")
+	settings := fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", directory)
+
+	if e := ioutil.WriteFile(config, []byte(settings), 0600); e != nil {
+		t.Fatalf("unable to write SoftHSM config: %s", e.Error())
+	}
+
+	t.Setenv("SOFTHSM2_CONF", config)
+	context := pkcs11.New(module)
+
+	if context == nil {
+		t.Fatalf("unable to load %s", module)
+	}
+
+	if e := context.Initialize(); e != nil {
+		t.Fatalf("unable to initialize SoftHSM: %s", e.Error())
+	}
+
+	// The key is opened with its own context, so this one has to be released before the tests run.
+	defer context.Destroy()
+	defer context.Finalize()
+
+	slots, e := context.GetSlotList(false)
+
+	if e != nil || len(slots) == 0 {
+		t.Fatalf("no SoftHSM slots available: %v", e)
+	}
+
+	if e := context.InitToken(slots[0], "so-pin", "beacon"); e != nil {
+		t.Fatalf("unable to initialize token: %s", e.Error())
+	}
+
+	// SoftHSM moves initialized tokens onto a new slot.
+	slots, e = context.GetSlotList(true)
+
+	if e != nil || len(slots) == 0 {
+		t.Fatalf("initialized token not found: %v", e)
+	}
+
+	session, e := context.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+
+	if e != nil {
+		t.Fatalf("unable to open session: %s", e.Error())
+	}
+
+	defer context.CloseSession(session)
+
+	if e := context.Login(session, pkcs11.CKU_SO, "so-pin"); e != nil {
+		t.Fatalf("unable to log in: %s", e.Error())
+	}
+
+	if e := context.InitPIN(session, "1234"); e != nil {
+		t.Fatalf("unable to set pin: %s", e.Error())
+	}
+
+	context.Logout(session)
+
+	if e := context.Login(session, pkcs11.CKU_USER, "1234"); e != nil {
+		t.Fatalf("unable to log in: %s", e.Error())
+	}
+
+	defer context.Logout(session)
+	curve, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+	pairs := []struct {
+		mechanism uint
+		label     string
+		public    []*pkcs11.Attribute
+		private   []*pkcs11.Attribute
+	}{
+		{
+			pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN,
+			"rsa-device",
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+				pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			},
+			[]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true)},
+		},
+		{
+			pkcs11.CKM_EC_KEY_PAIR_GEN,
+			"ecdsa-device",
+			[]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, curve)},
+			[]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true)},
+		},
+	}
+
+	for _, pair := range pairs {
+		public := append(pair.public,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, pair.label),
+		)
+		private := append(pair.private,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, pair.label),
+		)
+		mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pair.mechanism, nil)}
+
+		if _, _, e := context.GenerateKeyPair(session, mechanism, public, private); e != nil {
+			t.Fatalf("unable to generate %s: %s", pair.label, e.Error())
+		}
+	}
+
+	return module
+}
+
+func openSoftHSMKey(t *testing.T, module string, object string, pin string) *TokenKey {
+	t.Helper()
+	uri := fmt.Sprintf("pkcs11:token=beacon;object=%s?module-path=%s", object, module)
+	key, e := OpenTokenKey(uri, staticPassphrase(pin))
+
+	if e != nil {
+		t.Fatalf("unable to open %s: %s", object, e.Error())
+	}
+
+	return key
+}
+
+func TestTokenKeySoftHSM(t *testing.T) {
+	module := softHSMToken(t)
+	digest := sha256.Sum256([]byte("message"))
+	message := []byte("a digest")
+
+	t.Run("rsa", func(t *testing.T) {
+		key := openSoftHSMKey(t, module, "rsa-device", "1234")
+		defer key.Close()
+		public, ok := key.Public().(*rsa.PublicKey)
+
+		if ok != true || key.Type() != RSAKeyType {
+			t.Fatalf("expected an rsa key, got %s", key.Type())
+		}
+
+		signature, scheme, e := Sign(rand.Reader, key, digest[:])
+
+		if e != nil || scheme != RSAPSSSignature {
+			t.Fatalf("unable to sign with rsa-pss: %v (%s)", e, scheme)
+		}
+
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+		if e := rsa.VerifyPSS(public, crypto.SHA256, digest[:], signature, options); e != nil {
+			t.Fatalf("rsa-pss signature does not verify: %s", e.Error())
+		}
+
+		signature, e = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+
+		if e != nil {
+			t.Fatalf("unable to sign with pkcs#1 v1.5: %s", e.Error())
+		}
+
+		if e := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature); e != nil {
+			t.Fatalf("pkcs#1 v1.5 signature does not verify: %s", e.Error())
+		}
+
+		encrypted, e := Encrypt(public, message)
+
+		if e != nil {
+			t.Fatalf("unable to encrypt: %s", e.Error())
+		}
+
+		decrypted, e := key.Decrypt(rand.Reader, encrypted, nil)
+
+		if e != nil || bytes.Equal(decrypted, message) != true {
+			t.Fatalf("unable to decrypt with oaep: %q (%v)", decrypted, e)
+		}
+	})
+
+	t.Run("ecdsa", func(t *testing.T) {
+		key := openSoftHSMKey(t, module, "ecdsa-device", "1234")
+		defer key.Close()
+		public, ok := key.Public().(*ecdsa.PublicKey)
+
+		if ok != true || key.Type() != ECDSAKeyType {
+			t.Fatalf("expected an ecdsa key, got %s", key.Type())
+		}
+
+		signature, scheme, e := Sign(rand.Reader, key, digest[:])
+
+		if e != nil || scheme != ECDSASignature {
+			t.Fatalf("unable to sign with ecdsa: %v (%s)", e, scheme)
+		}
+
+		if ecdsa.VerifyASN1(public, digest[:], signature) != true {
+			t.Fatalf("ecdsa signature does not verify")
+		}
+
+		encrypted, e := Encrypt(public, message)
+
+		if e != nil {
+			t.Fatalf("unable to encrypt: %s", e.Error())
+		}
+
+		decrypted, e := key.Decrypt(rand.Reader, encrypted, nil)
+
+		if e != nil || bytes.Equal(decrypted, message) != true {
+			t.Fatalf("unable to decrypt with ecdh: %q (%v)", decrypted, e)
+		}
+	})
+
+	t.Run("wrong pin", func(t *testing.T) {
+		uri := fmt.Sprintf("pkcs11:token=beacon;object=rsa-device?module-path=%s", module)
+
+		if _, e := OpenTokenKey(uri, staticPassphrase("0000")); e == nil {
+			t.Fatalf("expected the token to refuse the wrong pin")
+		}
+	})
+}
@@ -13,6 +13,6 @@ func (logger *StateLogger) Close() {}
 
 // SetState logs out the state received by the "device"
 func (logger *StateLogger) SetState(state blink1.State) error {
-	logger.Debugf("received rgb(%d,%d,%d)", state.Red, state.Green, state.Blue)
+	logger.Infof("received rgb(%d,%d,%d)", state.Red, state.Green, state.Blue)
 	return nil
 }
@@ -2,6 +2,8 @@ package beacon
 
 import "io"
 import "fmt"
+import "sync"
+import "time"
 import "bytes"
 import "net/url"
 import "net/http"
@@ -9,6 +11,8 @@ import "encoding/json"
 import "github.com/gorilla/websocket"
 
 import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
 
 // WebsocketConfig holds the necessary information to subscribe to the api via websocket
 type WebsocketConfig struct {
@@ -16,9 +20,12 @@ type WebsocketConfig struct {
 	Secret  string
 }
 
-// WebsocketSubscriber is a websocket implementation of the Subscriber interface
+// WebsocketSubscriber is a websocket implementation of the Subscriber interface. The connection is guarded by a
+// mutex; it is replaced by Connect while the heartbeat is pinging it and Close may be called from any goroutine.
 type WebsocketSubscriber struct {
-	Config     WebsocketConfig
+	Config WebsocketConfig
+
+	lock       sync.Mutex
 	connection *websocket.Conn
 	connected  uint
 }
@@ -50,14 +57,16 @@ func (subscriber *WebsocketSubscriber) Preregister(name string) error {
 
 // Ping simply writes the data to the websocket
 func (subscriber *WebsocketSubscriber) Ping(data []byte) error {
-	if subscriber.connection == nil {
+	connection := subscriber.current()
+
+	if connection == nil {
 		return fmt.Errorf("connection-closed")
 	}
 
-	writer, e := subscriber.connection.NextWriter(websocket.TextMessage)
+	writer, e := connection.NextWriter(websocket.TextMessage)
 
 	if e != nil {
-		subscriber.connected = 0
+		subscriber.lost(connection)
 		return e
 	}
 
@@ -66,12 +75,12 @@ func (subscriber *WebsocketSubscriber) Ping(data []byte) error {
 	amt, e := writer.Write(data)
 
 	if e != nil {
-		subscriber.connected = 0
+		subscriber.lost(connection)
 		return e
 	}
 
 	if amt == 0 {
-		subscriber.connected = 0
+		subscriber.lost(connection)
 		return fmt.Errorf("unable to write into buffer")
 	}
 
@@ -80,21 +89,23 @@ func (subscriber *WebsocketSubscriber) Ping(data []byte) error {
 
 // ReadInto opens a new reader from the websocket and copies the data into the writer
 func (subscriber *WebsocketSubscriber) ReadInto(writer io.Writer) error {
-	if subscriber.connection == nil {
+	connection := subscriber.current()
+
+	if connection == nil {
 		return fmt.Errorf("connection-closed")
 	}
 
-	_, r, e := subscriber.connection.NextReader()
+	_, r, e := connection.NextReader()
 
 	if e != nil {
-		subscriber.connected = 0
+		subscriber.lost(connection)
 		return e
 	}
 
 	_, e = io.Copy(writer, r)
 
 	if e != nil {
-		subscriber.connected = 0
+		subscriber.lost(connection)
 	}
 
 	return e
@@ -102,35 +113,56 @@ func (subscriber *WebsocketSubscriber) ReadInto(writer io.Writer) error {
 
 // Connected returns true while the websocket is open
 func (subscriber *WebsocketSubscriber) Connected() bool {
+	subscriber.lock.Lock()
+	defer subscriber.lock.Unlock()
 	return subscriber.connected == 1
 }
 
-// Close closes the websocket connection
+// Close sends a close frame to the api (if still connected) before closing the websocket connection
 func (subscriber *WebsocketSubscriber) Close() error {
-	subscriber.connected = 0
+	subscriber.lock.Lock()
+	connection, connected := subscriber.connection, subscriber.connected == 1
+	subscriber.connection = nil
+	subscriber.setConnected(0)
+	subscriber.lock.Unlock()
 
-	if subscriber.connection == nil {
+	if connection == nil {
 		return nil
 	}
 
-	return subscriber.connection.Close()
+	if connected {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		deadline := time.Now().Add(defs.APICloseFrameTimeout)
+		connection.WriteControl(websocket.CloseMessage, message, deadline)
+	}
+
+	return connection.Close()
 }
 
-// Connect opens the websocket connection
-func (subscriber *WebsocketSubscriber) Connect() (e error) {
-	if subscriber.connection != nil {
-		subscriber.Close()
-	}
+// Connect opens the websocket connection, closing the previous one (if any) first.
+func (subscriber *WebsocketSubscriber) Connect() error {
+	subscriber.Close()
 
 	config, header, dialer := subscriber.Config, http.Header{}, websocket.Dialer{}
 	header.Set(defs.APIAuthorizationHeader, config.Secret)
-	subscriber.connection, _, e = dialer.Dial(subscriber.websocketAddress(), header)
+	logging.RegisterSecret(config.Secret)
+	connection, _, e := dialer.Dial(subscriber.websocketAddress(), header)
+
+	if e != nil {
+		return e
+	}
 
-	if e == nil {
-		subscriber.connected = 1
+	subscriber.lock.Lock()
+	defer subscriber.lock.Unlock()
+
+	// Connecting twice at once would leave one of the connections behind; only the last one is kept open.
+	if subscriber.connection != nil {
+		subscriber.connection.Close()
 	}
 
-	return
+	subscriber.connection = connection
+	subscriber.setConnected(1)
+	return nil
 }
 
 func (subscriber *WebsocketSubscriber) websocketAddress() string {
@@ -165,3 +197,27 @@ func (subscriber *WebsocketSubscriber) registrationAddress() string {
 	u.Path = defs.APIRegistrationEndpoint
 	return u.String()
 }
+
+// current returns the open connection, or nil when there is none.
+func (subscriber *WebsocketSubscriber) current() *websocket.Conn {
+	subscriber.lock.Lock()
+	defer subscriber.lock.Unlock()
+	return subscriber.connection
+}
+
+// lost marks the subscriber as disconnected after the connection failed, unless it has already been replaced.
+func (subscriber *WebsocketSubscriber) lost(connection *websocket.Conn) {
+	subscriber.lock.Lock()
+	defer subscriber.lock.Unlock()
+
+	if subscriber.connection == connection {
+		subscriber.setConnected(0)
+	}
+}
+
+// setConnected records the state of the websocket, keeping the connection state metric in step with it. The lock must
+// be held by the caller.
+func (subscriber *WebsocketSubscriber) setConnected(state uint) {
+	subscriber.connected = state
+	metrics.Connected.Set(float64(state))
+}
@@ -0,0 +1,100 @@
+package beacon
+
+import "sync"
+import "time"
+import "bytes"
+import "testing"
+import "net/url"
+import "net/http"
+import "sync/atomic"
+import "net/http/httptest"
+import "github.com/gorilla/websocket"
+
+func TestWebsocketSubscriberConcurrentReconnects(t *testing.T) {
+	open, upgrader := int32(0), websocket.Upgrader{}
+
+	// The api keeps every connection open until the client closes it, tracking how many are open.
+	api := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		connection, e := upgrader.Upgrade(response, request, nil)
+
+		if e != nil {
+			return
+		}
+
+		atomic.AddInt32(&open, 1)
+		defer atomic.AddInt32(&open, -1)
+		defer connection.Close()
+
+		for {
+			if _, _, e := connection.NextReader(); e != nil {
+				return
+			}
+		}
+	}))
+
+	defer api.Close()
+	apiHome, _ := url.Parse(api.URL)
+	subscriber := &WebsocketSubscriber{Config: WebsocketConfig{APIHome: *apiHome, Secret: "websocket-secret"}}
+	wg, done := sync.WaitGroup{}, make(chan struct{})
+
+	// Reconnect over and over while the heartbeat pings, a reader reads and shutdown closes the subscriber.
+	workers := []func(){
+		func() { subscriber.Ping([]byte("ping")) },
+		func() { subscriber.ReadInto(bytes.NewBuffer(nil)) },
+		func() { subscriber.Close() },
+	}
+
+	for _, work := range workers {
+		wg.Add(1)
+
+		go func(work func()) {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					work()
+				}
+			}
+		}(work)
+	}
+
+	for i := 0; i < 20; i++ {
+		subscriber.Connect()
+	}
+
+	close(done)
+	finished := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	// The reader may still be blocked on the last connection; keep closing until every worker has stopped.
+	for stopped := false; stopped != true; {
+		subscriber.Close()
+
+		select {
+		case <-finished:
+			stopped = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if subscriber.Connected() {
+		t.Fatalf("subscriber still connected after being closed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for atomic.LoadInt32(&open) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections were left open", atomic.LoadInt32(&open))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
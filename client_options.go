@@ -0,0 +1,340 @@
+package main
+
+import "os"
+import "fmt"
+import "net"
+import "flag"
+import "strings"
+import "net/url"
+import "io/ioutil"
+import "gopkg.in/yaml.v2"
+
+import "github.com/dadleyy/beacon.client/beacon"
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+// clientOptions holds every setting of the client. Each one is named after its flag and, unless given on the command
+// line, can also be set by a BEACON_ prefixed environment variable or a key in the config file (in that order).
+type clientOptions struct {
+	configFile      string
+	watchConfig     bool
+	apiHome         string
+	dryRun          bool
+	deviceIndex     int
+	commandBuffer   int
+	heartbeatDelay  int
+	privateKeyfile  string
+	deviceName      string
+	maxRetries      int
+	retryDelay      int
+	maxRetryDelay   int
+	retryJitter     float64
+	disconnected    string
+	disconnectRGB   string
+	outboxDir       string
+	outboxSize      int
+	outboxPolicy    string
+	legacyDigests   bool
+	maxClockSkew    int
+	passphraseFile  string
+	stateDir        string
+	approveKey      string
+	shutdownColor   string
+	shutdownTimeout int
+	logFormat       string
+	logOutput       string
+	logLevel        string
+	componentLevels string
+	logFile         string
+	logMaxSize      int
+	logMaxAge       int
+	logMaxBackups   int
+	logCompress     bool
+	unsafeLogging   bool
+	metricsAddress  string
+}
+
+// flagAliases maps deprecated flag names onto the flags that replaced them.
+var flagAliases = map[string]string{
+	"privte-key": "private-key",
+	"debug":      "dry-run",
+}
+
+// newClientFlags binds the client options to a new flag set.
+func newClientFlags(name string, handling flag.ErrorHandling, options *clientOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, handling)
+	flags.StringVar(&options.configFile, "config", "", "a yaml file containing any of the settings below")
+	flags.BoolVar(&options.watchConfig, "watch-config", false, "if true, the config file is reloaded when it changes")
+	flags.StringVar(&options.apiHome, "api", "http://0.0.0.0:8080", "the hostname of the beacon.api server")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "if true, device states are logged instead of sent to the device")
+	flags.BoolVar(&options.dryRun, "debug", false, "deprecated alias of -dry-run")
+	flags.IntVar(&options.deviceIndex, "device-index", 0, "which blink1 to use when several are plugged in, from 0")
+	flags.IntVar(&options.commandBuffer, "command-buffer", 2, "amount of allowed commands to buffer")
+	flags.IntVar(&options.heartbeatDelay, "heartbeat-delay", 10, "amount of seconds between heartbeat pings")
+	flags.IntVar(&options.retryDelay, "retry-delay", 5, "amount of seconds to wait before the first retry")
+	flags.IntVar(&options.maxRetryDelay, "max-retry-delay", 300, "the most seconds to wait between retries")
+	flags.Float64Var(&options.retryJitter, "retry-jitter", 0.5, "fraction (0-1) of each retry delay to randomize")
+	flags.IntVar(&options.maxRetries, "max-retries", 10, "amount of attempts to reconnect, 0 retries forever")
+	flags.StringVar(&options.disconnected, "disconnected-pattern", defs.BreathePatternName, "none|off|solid|blink|breathe")
+	flags.StringVar(&options.disconnectRGB, "disconnected-color", "ff0000", "hex color of the disconnected pattern")
+	flags.StringVar(&options.privateKeyfile, "private-key", ".keys/private.pem", "the private key filename or pkcs11 uri")
+	flags.StringVar(&options.privateKeyfile, "privte-key", ".keys/private.pem", "deprecated alias of -private-key")
+	flags.StringVar(&options.deviceName, "device-name", "", "if provided, this will attempt to pre-register with the api")
+	flags.StringVar(&options.outboxDir, "feedback-outbox", ".feedback", "directory used to queue undelivered feedback")
+	flags.IntVar(&options.outboxSize, "feedback-outbox-size", 1000, "the max amount of queued feedback messages")
+	flags.StringVar(&options.outboxPolicy, "feedback-drop-policy", defs.OutboxDropOldestPolicy, "drop-oldest|drop-newest")
+	flags.BoolVar(&options.legacyDigests, "legacy-digests", false, "if true, digests are not required to match payloads")
+	flags.IntVar(&options.maxClockSkew, "max-clock-skew", 30, "amount of seconds messages may be issued from local time")
+	flags.StringVar(&options.passphraseFile, "key-passphrase-file", "", "a file containing the private key passphrase")
+	flags.StringVar(&options.stateDir, "state-dir", ".beacon", "the directory used to persist the pinned server key")
+	flags.StringVar(&options.approveKey, "approve-server-key", "", "fingerprint of a changed server key to trust")
+	flags.StringVar(&options.shutdownColor, "shutdown-color", "000000", "hex color left on the device after shutdown")
+	flags.IntVar(&options.shutdownTimeout, "shutdown-timeout", 5, "seconds spent delivering feedback on shutdown")
+	flags.StringVar(&options.logFormat, "log-format", defs.TextLogFormat, "text | json")
+	flags.StringVar(&options.logOutput, "log-output", defs.StdoutLogOutput, "stdout | syslog | journald | file")
+	flags.StringVar(&options.logLevel, "log-level", defs.InfoLogLevelTag, "debug | info | warn | error")
+	flags.StringVar(&options.componentLevels, "component-log-levels", "", "component levels, e.g heartbeat-processor=warn")
+	flags.StringVar(&options.logFile, "log-file", "beacon-client.log", "the file written to when -log-output is file")
+	flags.IntVar(&options.logMaxSize, "log-max-size", 10, "megabytes written to the log file before it rotates")
+	flags.IntVar(&options.logMaxAge, "log-max-age", 24, "hours the log file is written to before it rotates")
+	flags.IntVar(&options.logMaxBackups, "log-max-backups", 5, "amount of rotated log files kept, 0 keeps all of them")
+	flags.BoolVar(&options.logCompress, "log-compress", true, "if true, rotated log files are gzipped")
+	flags.StringVar(&options.metricsAddress, "metrics-address", "", "address (e.g :9100) to serve prometheus metrics on")
+	flags.BoolVar(&options.unsafeLogging, "unsafe-log-secrets", false, "if true, secrets are not redacted from logs")
+	return flags
+}
+
+// loadClientOptions parses the command line and fills in every option it did not set from the environment, then from
+// the config file. Problems are collected rather than returned one at a time so that they can all be reported at once.
+func loadClientOptions(flags *flag.FlagSet, options *clientOptions, args []string) []error {
+	if e := flags.Parse(args); e != nil {
+		return []error{e}
+	}
+
+	explicit := make(map[string]bool)
+
+	flags.Visit(func(f *flag.Flag) {
+		explicit[canonicalFlagName(f.Name)] = true
+	})
+
+	// The config file location itself can only come from the command line or the environment.
+	if explicit["config"] != true {
+		if value, ok := os.LookupEnv(optionEnvVariable("config")); ok {
+			options.configFile = value
+		}
+	}
+
+	settings, problems := readConfigFile(options.configFile)
+
+	for name := range settings {
+		canonical := canonicalFlagName(name)
+
+		if flags.Lookup(canonical) == nil || canonical == "config" {
+			problems = append(problems, fmt.Errorf("unknown setting \"%s\" in %s", name, options.configFile))
+			continue
+		}
+
+		// Settings given with the deprecated name apply unless the current name is also present.
+		if _, ok := settings[canonical]; canonical != name && ok != true {
+			settings[canonical] = settings[name]
+		}
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if _, alias := flagAliases[f.Name]; alias || f.Name == "config" || explicit[f.Name] {
+			return
+		}
+
+		source, value, ok := optionEnvVariable(f.Name), "", false
+
+		if value, ok = os.LookupEnv(source); ok != true {
+			source = options.configFile
+			value, ok = settings[f.Name]
+		}
+
+		if ok != true {
+			return
+		}
+
+		if e := flags.Set(f.Name, value); e != nil {
+			problems = append(problems, fmt.Errorf("invalid value \"%s\" for %s (from %s): %s", value, f.Name, source, e))
+		}
+	})
+
+	return problems
+}
+
+// validate checks the values of the options, returning every problem found.
+func (options *clientOptions) validate() []error {
+	problems := make([]error, 0)
+
+	fail := func(format string, items ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, items...))
+	}
+
+	if apiHome, e := url.Parse(options.apiHome); e != nil {
+		fail("api: %s", e.Error())
+	} else if (apiHome.Scheme != "http" && apiHome.Scheme != "https") || apiHome.Host == "" {
+		fail("api: \"%s\" must be a full http(s)://hostname:port url", options.apiHome)
+	}
+
+	if strings.HasPrefix(options.privateKeyfile, security.TokenKeyScheme) != true {
+		if _, e := os.Stat(options.privateKeyfile); e != nil {
+			fail("private-key: %s", e.Error())
+		}
+	}
+
+	if options.passphraseFile != "" {
+		if _, e := os.Stat(options.passphraseFile); e != nil {
+			fail("key-passphrase-file: %s", e.Error())
+		}
+	}
+
+	if options.commandBuffer < 0 {
+		fail("command-buffer: must not be negative")
+	}
+
+	if options.deviceIndex < 0 {
+		fail("device-index: must not be negative")
+	}
+
+	if options.heartbeatDelay <= 0 {
+		fail("heartbeat-delay: must be positive")
+	}
+
+	if options.maxRetries < 0 {
+		fail("max-retries: must not be negative")
+	}
+
+	if options.retryDelay <= 0 || options.maxRetryDelay < options.retryDelay {
+		fail("retry-delay: must be positive and at most max-retry-delay (%d)", options.maxRetryDelay)
+	}
+
+	if options.retryJitter < 0 || options.retryJitter > 1 {
+		fail("retry-jitter: must be between 0 and 1")
+	}
+
+	if _, e := beacon.NewPattern(options.disconnected, options.disconnectRGB); e != nil {
+		fail("disconnected-pattern: %s", e.Error())
+	}
+
+	if _, e := beacon.ParseColor(options.shutdownColor); e != nil {
+		fail("shutdown-color: %s", e.Error())
+	}
+
+	if options.shutdownTimeout < 0 {
+		fail("shutdown-timeout: must not be negative")
+	}
+
+	if options.outboxSize <= 0 {
+		fail("feedback-outbox-size: must be positive")
+	}
+
+	if options.outboxPolicy != defs.OutboxDropOldestPolicy && options.outboxPolicy != defs.OutboxDropNewestPolicy {
+		fail("feedback-drop-policy: must be %s or %s", defs.OutboxDropOldestPolicy, defs.OutboxDropNewestPolicy)
+	}
+
+	if options.maxClockSkew <= 0 {
+		fail("max-clock-skew: must be positive")
+	}
+
+	if options.logFormat != defs.TextLogFormat && options.logFormat != defs.JSONLogFormat {
+		fail("log-format: must be %s or %s", defs.TextLogFormat, defs.JSONLogFormat)
+	}
+
+	switch options.logOutput {
+	case defs.StdoutLogOutput, defs.SyslogLogOutput, defs.JournaldLogOutput:
+	case defs.FileLogOutput:
+		if options.logFile == "" {
+			fail("log-file: required when log-output is %s", defs.FileLogOutput)
+		}
+	default:
+		fail("log-output: must be stdout, syslog, journald or file")
+	}
+
+	if options.logMaxSize < 0 || options.logMaxAge < 0 || options.logMaxBackups < 0 {
+		fail("log-max-size, log-max-age and log-max-backups: must not be negative")
+	}
+
+	if options.metricsAddress != "" {
+		if _, _, e := net.SplitHostPort(options.metricsAddress); e != nil {
+			fail("metrics-address: %s", e.Error())
+		}
+	}
+
+	problems = append(problems, validateLogLevels(options)...)
+
+	return problems
+}
+
+// configCommand dispatches the `config` subcommands.
+func configCommand(args []string) error {
+	if len(args) < 1 || args[0] != "validate" {
+		return fmt.Errorf("usage: config validate [-config filename] [flags]")
+	}
+
+	options := &clientOptions{}
+	flags := newClientFlags("config validate", flag.ContinueOnError, options)
+	problems := append(loadClientOptions(flags, options, args[1:]), options.validate()...)
+	logger := logging.New(defs.RuntimeLoggerPrefix, logging.Green)
+
+	for _, problem := range problems {
+		logger.Errorf("%s", problem.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+
+	logger.Infof("configuration is valid")
+	return nil
+}
+
+// readConfigFile reads the flat yaml mapping of setting names to values from the file, if one was given. Settings
+// that are not a single value are left out and reported as problems.
+func readConfigFile(filename string) (map[string]string, []error) {
+	settings, problems := make(map[string]string), make([]error, 0)
+
+	if filename == "" {
+		return settings, problems
+	}
+
+	contents, e := ioutil.ReadFile(filename)
+
+	if e != nil {
+		return settings, append(problems, e)
+	}
+
+	values := make(map[string]interface{})
+
+	if e := yaml.Unmarshal(contents, &values); e != nil {
+		return settings, append(problems, fmt.Errorf("invalid config file %s: %s", filename, e.Error()))
+	}
+
+	for name, value := range values {
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			problems = append(problems, fmt.Errorf("setting \"%s\" in %s must be a single value", name, filename))
+		case nil:
+			settings[name] = ""
+		default:
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+
+	return settings, problems
+}
+
+// optionEnvVariable returns the name of the environment variable for the option, e.g BEACON_DEVICE_NAME.
+func optionEnvVariable(name string) string {
+	return defs.ConfigEnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func canonicalFlagName(name string) string {
+	if canonical, ok := flagAliases[name]; ok {
+		return canonical
+	}
+
+	return name
+}
@@ -0,0 +1,127 @@
+package main
+
+import "flag"
+import "strings"
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+
+// writeConfig writes the yaml into a config file in a temporary directory, returning its path.
+func writeConfig(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "client.yaml")
+
+	if e := ioutil.WriteFile(filename, []byte(contents), 0644); e != nil {
+		t.Fatalf("unable to write config file: %s", e.Error())
+	}
+
+	return filename
+}
+
+// loadOptions loads the options from the arguments, the environment and the config file named by either of them.
+func loadOptions(args ...string) (*clientOptions, []error) {
+	options := &clientOptions{}
+	flags := newClientFlags("beacon-client", flag.ContinueOnError, options)
+	flags.SetOutput(ioutil.Discard)
+	return options, loadClientOptions(flags, options, args)
+}
+
+func TestLoadClientOptionsPrecedence(t *testing.T) {
+	config := writeConfig(t, strings.Join([]string{
+		"api: http://file:8080",
+		"device-name: file-device",
+		"heartbeat-delay: 7",
+		"max-retries: 3",
+	}, "\n"))
+
+	t.Setenv("BEACON_API", "http://env:8080")
+	t.Setenv("BEACON_DEVICE_NAME", "env-device")
+	options, problems := loadOptions("-config", config, "-api", "http://flag:8080")
+
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	if options.apiHome != "http://flag:8080" {
+		t.Fatalf("expected the flag to take precedence, got %s", options.apiHome)
+	}
+
+	if options.deviceName != "env-device" {
+		t.Fatalf("expected the environment to take precedence over the file, got %s", options.deviceName)
+	}
+
+	if options.heartbeatDelay != 7 || options.maxRetries != 3 {
+		t.Fatalf("expected settings only in the file to apply, got %d and %d", options.heartbeatDelay, options.maxRetries)
+	}
+
+	if options.commandBuffer != 2 {
+		t.Fatalf("expected unset settings to keep their default, got %d", options.commandBuffer)
+	}
+}
+
+func TestLoadClientOptionsConfigFromEnvironment(t *testing.T) {
+	t.Setenv("BEACON_CONFIG", writeConfig(t, "device-name: file-device"))
+	options, problems := loadOptions()
+
+	if len(problems) != 0 || options.deviceName != "file-device" {
+		t.Fatalf("expected the config file named by the environment to be read, got %q (%v)", options.deviceName, problems)
+	}
+}
+
+func TestLoadClientOptionsDeprecatedAliases(t *testing.T) {
+	options, problems := loadOptions("-config", writeConfig(t, "privte-key: old.pem\ndebug: true"))
+
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	if options.privateKeyfile != "old.pem" || options.dryRun != true {
+		t.Fatalf("expected deprecated settings to apply, got %s and %v", options.privateKeyfile, options.dryRun)
+	}
+
+	// The current name wins over the deprecated one when a file has both.
+	options, problems = loadOptions("-config", writeConfig(t, "privte-key: old.pem\nprivate-key: new.pem"))
+
+	if len(problems) != 0 || options.privateKeyfile != "new.pem" {
+		t.Fatalf("expected the current setting to win, got %s (%v)", options.privateKeyfile, problems)
+	}
+
+	// A deprecated flag counts as setting the current one, so the environment does not override it.
+	t.Setenv("BEACON_PRIVATE_KEY", "env.pem")
+	options, problems = loadOptions("-privte-key", "flag.pem")
+
+	if len(problems) != 0 || options.privateKeyfile != "flag.pem" {
+		t.Fatalf("expected the deprecated flag to win, got %s (%v)", options.privateKeyfile, problems)
+	}
+}
+
+func TestLoadClientOptionsReportsProblems(t *testing.T) {
+	config := writeConfig(t, strings.Join([]string{
+		"colour: red",
+		"config: other.yaml",
+		"heartbeat-delay: often",
+		"device-name: lobby",
+	}, "\n"))
+
+	options, problems := loadOptions("-config", config)
+	expected := []string{"unknown setting \"colour\"", "unknown setting \"config\"", "invalid value \"often\""}
+
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+
+	for _, description := range expected {
+		found := false
+
+		for _, problem := range problems {
+			found = found || strings.Contains(problem.Error(), description)
+		}
+
+		if found != true {
+			t.Fatalf("expected a problem mentioning %s, got %v", description, problems)
+		}
+	}
+
+	if options.deviceName != "lobby" {
+		t.Fatalf("expected valid settings to apply alongside the problems, got %s", options.deviceName)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import "io"
+import "os"
+import "fmt"
+import "flag"
+import "strings"
+import "net/url"
+import "io/ioutil"
+
+import "github.com/dadleyy/beacon.client/beacon"
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+// keygen generates a new device key and writes it to disk, refusing to replace an existing key unless forced.
+func keygen(args []string) error {
+	options := struct {
+		privateKeyfile string
+		keyType        string
+		bits           int
+		force          bool
+		encrypt        bool
+		passphraseFile string
+	}{}
+
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	flags.StringVar(&options.privateKeyfile, "private-key", ".keys/private.pem", "the filename to write the key to")
+	flags.StringVar(&options.keyType, "type", security.RSAKeyType, "the type of key to generate: rsa, ecdsa or ed25519")
+	flags.IntVar(&options.bits, "bits", 0, "the size of the key (or curve) to generate, zero uses the default")
+	flags.BoolVar(&options.force, "force", false, "if true, an existing key file will be overwritten")
+	flags.BoolVar(&options.encrypt, "encrypt", false, "if true, the key will be encrypted with a passphrase")
+	flags.StringVar(&options.passphraseFile, "key-passphrase-file", "", "a file containing the key passphrase")
+	flags.Parse(args)
+
+	logger := logging.New(defs.RuntimeLoggerPrefix, logging.Green)
+	key, e := security.GenerateDeviceKey(options.keyType, options.bits)
+
+	if e != nil {
+		return e
+	}
+
+	var passphrase []byte
+
+	if options.encrypt {
+		passphrase, e = keyPassphrase(options.passphraseFile)()
+
+		if e != nil {
+			return e
+		}
+	}
+
+	if e := key.WriteToFile(options.privateKeyfile, options.force, passphrase); e != nil {
+		return e
+	}
+
+	fingerprint, e := key.Fingerprint()
+
+	if e != nil {
+		return e
+	}
+
+	logger.Infof("wrote %s key to %s (%s)", options.keyType, options.privateKeyfile, fingerprint)
+	return nil
+}
+
+// keyCommand dispatches the `key` subcommands.
+func keyCommand(args []string) error {
+	if len(args) < 1 || args[0] != "show" {
+		return fmt.Errorf("usage: key show [-private-key filename]")
+	}
+
+	flags := flag.NewFlagSet("key show", flag.ExitOnError)
+	privateKeyfile := flags.String("private-key", ".keys/private.pem", "the filename (or pkcs11 uri) of the private key")
+	passphraseFile := flags.String("key-passphrase-file", "", "a file containing the key passphrase")
+	flags.Parse(args[1:])
+
+	key, e := security.OpenDeviceKey(*privateKeyfile, keyPassphrase(*passphraseFile))
+
+	if e != nil {
+		return e
+	}
+
+	if closer, ok := key.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	sharedSecret, e := key.SharedSecret()
+
+	if e != nil {
+		return e
+	}
+
+	fingerprint, e := key.Fingerprint()
+
+	if e != nil {
+		return e
+	}
+
+	fmt.Printf("type:          %s\nfingerprint:   %s\nshared secret: %s\n", key.Type(), fingerprint, sharedSecret)
+	return nil
+}
+
+// rotateKey replaces the device key with a newly generated one. The new key is staged next to the current one and
+// only moved into place once the api has acknowledged it; if the swap fails the api is asked to rotate back.
+func rotateKey(args []string) error {
+	options := struct {
+		apiHome        string
+		privateKeyfile string
+		keyType        string
+		bits           int
+		encrypt        bool
+		passphraseFile string
+	}{}
+
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	flags.StringVar(&options.apiHome, "api", "http://0.0.0.0:8080", "the hostname of the beacon.api server")
+	flags.StringVar(&options.privateKeyfile, "private-key", ".keys/private.pem", "the filename of the key to rotate")
+	flags.StringVar(&options.keyType, "type", "", "the type of the new key, defaults to the type of the current key")
+	flags.IntVar(&options.bits, "bits", 0, "the size of the key (or curve) to generate, zero uses the default")
+	flags.BoolVar(&options.encrypt, "encrypt", false, "if true, the new key will be encrypted even if the current is not")
+	flags.StringVar(&options.passphraseFile, "key-passphrase-file", "", "a file containing the key passphrase")
+	flags.Parse(args)
+
+	logger := logging.New(defs.RuntimeLoggerPrefix, logging.Green)
+	apiHome, e := url.Parse(options.apiHome)
+
+	if e != nil {
+		return e
+	}
+
+	// Token keys are generated and replaced on the token itself, the client can only rotate keys it stores in files.
+	if strings.HasPrefix(options.privateKeyfile, security.TokenKeyScheme) {
+		return fmt.Errorf("unsupported-key-location: rotate-key only supports key files, not pkcs11 uris")
+	}
+
+	// The passphrase is only read when the current key is encrypted; hold on to it so the new key can be encrypted too.
+	var currentPassphrase []byte
+	source := keyPassphrase(options.passphraseFile)
+	current, e := security.ReadDeviceKeyFromFile(options.privateKeyfile, func() ([]byte, error) {
+		passphrase, e := source()
+		currentPassphrase = append([]byte{}, passphrase...)
+		return passphrase, e
+	})
+
+	if e != nil {
+		return e
+	}
+
+	if options.keyType == "" {
+		options.keyType = current.Type()
+	}
+
+	replacement, e := security.GenerateDeviceKey(options.keyType, options.bits)
+
+	if e != nil {
+		return e
+	}
+
+	passphrase := currentPassphrase
+
+	if options.encrypt && len(passphrase) == 0 {
+		passphrase, e = source()
+
+		if e != nil {
+			return e
+		}
+	}
+
+	if len(currentPassphrase) > 0 {
+		logger.Infof("current key is encrypted, the new key will be encrypted with the same passphrase")
+	}
+
+	// Stage the new key on disk before telling the api about it so that it can never be lost once accepted.
+	staged, backup := options.privateKeyfile+".next", options.privateKeyfile+".previous"
+
+	if e := replacement.WriteToFile(staged, true, passphrase); e != nil {
+		return e
+	}
+
+	if e := beacon.RotateDeviceKey(*apiHome, current, replacement); e != nil {
+		if _, rejected := e.(*beacon.KeyRotationRejectedError); rejected != true {
+			// The api may have switched to the new key without us hearing about it; it is the only copy, keep it.
+			return fmt.Errorf("unable to confirm the api accepted the new key, it is kept at %s: %s", staged, e.Error())
+		}
+
+		os.Remove(staged)
+		return fmt.Errorf("api did not accept new key, keeping current key: %s", e.Error())
+	}
+
+	rollback := func(cause error) error {
+		logger.Warnf("unable to swap key files, rolling back: %s", cause.Error())
+
+		if e := beacon.RotateDeviceKey(*apiHome, replacement, current); e != nil {
+			return fmt.Errorf("rollback failed, the new key remains at %s: %s", staged, e.Error())
+		}
+
+		os.Remove(staged)
+		return cause
+	}
+
+	previous, e := ioutil.ReadFile(options.privateKeyfile)
+
+	if e != nil {
+		return rollback(e)
+	}
+
+	if e := ioutil.WriteFile(backup, previous, 0600); e != nil {
+		return rollback(e)
+	}
+
+	// Renaming within the same directory atomically replaces the key file.
+	if e := os.Rename(staged, options.privateKeyfile); e != nil {
+		return rollback(e)
+	}
+
+	fingerprint, e := replacement.Fingerprint()
+
+	if e != nil {
+		return e
+	}
+
+	logger.Infof("rotated %s to new %s key (%s)", options.privateKeyfile, options.keyType, fingerprint)
+	logger.Infof("previous key kept at %s", backup)
+	return nil
+}
+
+// keyPassphrase returns the source of the passphrase for encrypted keys: the passphrase file if one was given,
+// otherwise the environment variable if it is set, otherwise an interactive prompt. Whatever passphrase is read is
+// kept out of the logs.
+func keyPassphrase(passphraseFile string) security.Passphrase {
+	source := security.PassphraseFromTerminal(defs.KeyPassphrasePrompt)
+
+	if passphraseFile != "" {
+		source = security.PassphraseFromFile(passphraseFile)
+	} else if _, ok := os.LookupEnv(defs.KeyPassphraseEnvVariable); ok {
+		source = security.PassphraseFromEnv(defs.KeyPassphraseEnvVariable)
+	}
+
+	return func() ([]byte, error) {
+		passphrase, e := source()
+
+		if e == nil {
+			logging.RegisterSecret(string(passphrase))
+		}
+
+		return passphrase, e
+	}
+}
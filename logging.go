@@ -0,0 +1,133 @@
+package main
+
+import "io"
+import "os"
+import "fmt"
+import "time"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+
+// loggerPrefixes are the components whose level can be set individually.
+var loggerPrefixes = []string{
+	defs.RuntimeLoggerPrefix,
+	defs.DebugStateLoggerPrefix,
+	defs.FeedbackProcessorLoggerPrefix,
+	defs.HeartbeatProcessorLoggerPrefix,
+	defs.CommandProcessorLoggerPrefix,
+}
+
+// configureLogging points every logger at the backend selected by the options and applies the log levels.
+func configureLogging(options *clientOptions) error {
+	setup, e := openLogging(options)
+
+	if e != nil {
+		return e
+	}
+
+	setup.apply()
+	return nil
+}
+
+// loggingSetup is a logging configuration whose levels have been checked and backend opened, but not yet applied.
+type loggingSetup struct {
+	backend logging.Backend
+	levels  logging.Levels
+	unsafe  bool
+}
+
+// openLogging prepares the logging selected by the options without changing the current logging, so a configuration
+// that cannot be applied is reported before anything else is changed.
+func openLogging(options *clientOptions) (*loggingSetup, error) {
+	components, e := logging.ParseComponentLevels(options.componentLevels)
+
+	if e != nil {
+		return nil, e
+	}
+
+	levels, e := logging.ParseLevels(options.logLevel, components)
+
+	if e != nil {
+		return nil, e
+	}
+
+	backend, e := logBackend(options)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &loggingSetup{backend: backend, levels: levels, unsafe: options.unsafeLogging}, nil
+}
+
+// apply points every logger at the backend and applies the levels.
+func (setup *loggingSetup) apply() {
+	logging.ApplyLevels(setup.levels)
+	logging.SetBackend(setup.backend)
+	logging.SetUnsafe(setup.unsafe)
+}
+
+// discard closes the backend of a setup that will not be applied.
+func (setup *loggingSetup) discard() {
+	if closer, ok := setup.backend.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// logBackend opens the backend for the selected log output; the format only applies to stdout and files.
+func logBackend(options *clientOptions) (logging.Backend, error) {
+	switch options.logOutput {
+	case defs.SyslogLogOutput:
+		return logging.NewSyslogBackend(defs.LogIdentifier)
+	case defs.JournaldLogOutput:
+		return logging.NewJournaldBackend(defs.LogIdentifier, defs.JournaldSocketPath)
+	case defs.StdoutLogOutput:
+		return logging.NewBackend(options.logFormat, os.Stdout)
+	case defs.FileLogOutput:
+		return logging.NewFileBackend(options.logFormat, logging.RotationConfig{
+			Filename:   options.logFile,
+			MaxSize:    int64(options.logMaxSize) * 1024 * 1024,
+			MaxAge:     time.Duration(options.logMaxAge) * time.Hour,
+			MaxBackups: options.logMaxBackups,
+			Compress:   options.logCompress,
+		})
+	}
+
+	return nil, fmt.Errorf("invalid-log-output: %s", options.logOutput)
+}
+
+// validateLogLevels makes sure the levels are known and only name components that exist.
+func validateLogLevels(options *clientOptions) []error {
+	problems, known := make([]error, 0), make(map[string]bool)
+
+	for _, prefix := range loggerPrefixes {
+		known[logging.ComponentKey(prefix)] = true
+	}
+
+	levels := map[string]bool{
+		defs.DebugLogLevelTag: true,
+		defs.InfoLogLevelTag:  true,
+		defs.WarnLogLevelTag:  true,
+		defs.ErrorLogLevelTag: true,
+	}
+
+	if levels[options.logLevel] != true {
+		problems = append(problems, fmt.Errorf("log-level: must be debug, info, warn or error"))
+	}
+
+	components, e := logging.ParseComponentLevels(options.componentLevels)
+
+	if e != nil {
+		return append(problems, fmt.Errorf("component-log-levels: %s", e.Error()))
+	}
+
+	for component, level := range components {
+		if known[logging.ComponentKey(component)] != true {
+			problems = append(problems, fmt.Errorf("component-log-levels: unknown component \"%s\"", component))
+		} else if levels[level] != true {
+			problems = append(problems, fmt.Errorf("component-log-levels: invalid level \"%s\" for %s", level, component))
+		}
+	}
+
+	return problems
+}
@@ -1,9 +1,13 @@
 package main
 
+import "io"
+import "os"
+import "fmt"
 import "flag"
-import "sync"
 import "time"
-import "bytes"
+import "context"
+import "syscall"
+import "os/signal"
 import "net/url"
 
 import "github.com/hink/go-blink1"
@@ -13,175 +17,337 @@ import "github.com/dadleyy/beacon.client/beacon/logging"
 import "github.com/dadleyy/beacon.client/beacon/security"
 
 func main() {
-	options := struct {
-		apiHome        string
-		debugging      bool
-		commandBuffer  int
-		heartbeatDelay int
-		privateKeyfile string
-		deviceName     string
-		maxRetries     int
-		retryDelay     int
-	}{}
-
-	flag.StringVar(&options.apiHome, "api", "http://0.0.0.0:8080", "the hostname of the beacon.api server")
-	flag.BoolVar(&options.debugging, "debug", false, "if true, the client will not attempt to open the blink device")
-	flag.IntVar(&options.commandBuffer, "command-buffer", 2, "amount of allowed commands to buffer")
-	flag.IntVar(&options.heartbeatDelay, "heartbeat-delay", 10, "amount of seconds between heartbeat pings")
-	flag.IntVar(&options.retryDelay, "retry-delay", 5, "amount of seconds to wait before retrying")
-	flag.IntVar(&options.maxRetries, "max-retries", 10, "amount of attempts the client will attempt to reconnect")
-	flag.StringVar(&options.privateKeyfile, "privte-key", ".keys/private.pem", "the filename of the private key")
-	flag.StringVar(&options.deviceName, "device-name", "", "if provided, this will attempt to pre-register with the api")
-	flag.Parse()
-
-	if len(options.apiHome) < 1 {
-		flag.PrintDefaults()
-		return
+	subcommands := map[string]func([]string) error{
+		"keygen":     keygen,
+		"key":        keyCommand,
+		"rotate-key": rotateKey,
+		"config":     configCommand,
 	}
 
+	// Subcommands are dispatched before any of the client flags are parsed.
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			if e := command(os.Args[2:]); e != nil {
+				logging.New(defs.RuntimeLoggerPrefix, logging.Green).Errorf("%s failed: %s", os.Args[1], e.Error())
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
+
+	os.Exit(run())
+}
+
+// run starts the client, returning the status code the process should exit with. The client is restarted whenever a
+// reload changes a setting that cannot be applied to it while running.
+func run() int {
+	options := &clientOptions{}
+	flags := newClientFlags(os.Args[0], flag.ExitOnError, options)
+	problems := append(loadClientOptions(flags, options, os.Args[1:]), options.validate()...)
+
+	// Problems are reported in the requested format whenever it is usable (an unusable one is among the problems).
+	loggingError := configureLogging(options)
+
 	// At this point we have aparently reasonable cli options, create the logger that will be used in this main thread.
 	logger := logging.New(defs.RuntimeLoggerPrefix, logging.Green)
 
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Errorf("%s", problem.Error())
+		}
+
+		return defs.ExitCodeStartupFailure
+	}
+
+	// The options were valid but the backend could not be opened; refuse to run with logs going somewhere unexpected.
+	if loggingError != nil {
+		logger.Errorf("unable to configure logging: %s", loggingError.Error())
+		return defs.ExitCodeStartupFailure
+	}
+
+	if options.unsafeLogging {
+		logger.Warnf("secrets are not being redacted from the logs, only use -unsafe-log-secrets while debugging")
+	}
+
+	// Stop the client on the first interrupt or termination signal; a second one exits without waiting any longer.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		received := <-signals
+		logger.Infof("received %s, shutting down", received)
+		cancel()
+
+		received = <-signals
+		logger.Errorf("received %s during shutdown, exiting immediately", received)
+		os.Exit(defs.ExitCodeInterrupted)
+	}()
+
+	// The configuration is reloaded on SIGHUP and, if requested, whenever the config file changes.
+	reloads := make(chan struct{}, 1)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			logger.Infof("received hangup, reloading configuration")
+			requestReload(reloads)
+		}
+	}()
+
+	// SIGUSR1 reopens the log file, for use with logrotate (or anything else moving the file out of the way).
+	reopens := make(chan os.Signal, 1)
+	signal.Notify(reopens, syscall.SIGUSR1)
+
+	go func() {
+		for range reopens {
+			if e := logging.Reopen(); e != nil {
+				logger.Errorf("unable to reopen log file: %s", e.Error())
+			}
+		}
+	}()
+
+	for {
+		code, next := serve(ctx, logger, options, reloads)
+
+		if next == nil {
+			return code
+		}
+
+		logger.Infof("restarting client to apply new configuration")
+		options = next
+	}
+}
+
+// serve runs a client built from the options until it stops, returning the status code the process should exit with.
+// Reloaded options that can be applied to the running client are; otherwise the client is stopped and the new options
+// are returned so that a new client can be started with them.
+func serve(
+	ctx context.Context, logger logging.Logger, options *clientOptions, reloads chan struct{},
+) (int, *clientOptions) {
 	// Attempt to parse the url provided by the user - should be in full http://hostname:port format.
 	apiHome, e := url.Parse(options.apiHome)
 
 	if e != nil {
 		logger.Errorf("invalid api (%s) host: %s", options.apiHome, e.Error())
-		return
+		return defs.ExitCodeStartupFailure, nil
 	}
 
-	// Load the RSA private key file. This will be used to create the public key that will be sent to the server.
-	key, e := security.ReadDeviceKeyFromFile(options.privateKeyfile)
+	// Remember what the key looked like when it was loaded; one replaced in place is only noticed by comparing this.
+	loadedKey, e := keyState(options.privateKeyfile)
 
 	if e != nil {
-		logger.Errorf("invalid file name: %s", e.Error())
-		return
+		logger.Errorf("unable to load device key: %s", e.Error())
+		return defs.ExitCodeStartupFailure, nil
+	}
+
+	// Load the private key (a rsa, ecdsa or ed25519 file, or a pkcs11 token). Its public key is the shared secret.
+	key, e := security.OpenDeviceKey(options.privateKeyfile, keyPassphrase(options.passphraseFile))
+
+	if e != nil {
+		logger.Errorf("unable to load device key: %s", e.Error())
+		return defs.ExitCodeStartupFailure, nil
+	}
+
+	// Keys that live on a PKCS#11 token hold a session open that needs to be closed.
+	if closer, ok := key.(io.Closer); ok {
+		defer closer.Close()
 	}
 
 	// Attempt to generate the shared secret that will be given to the server for encrypting digests to the device.
 	sharedSecret, e := key.SharedSecret()
 
 	if e != nil {
-		logger.Errorf("invalid file name: %s", e.Error())
-		return
+		logger.Errorf("unable to create shared secret: %s", e.Error())
+		return defs.ExitCodeStartupFailure, nil
+	}
+
+	// The shared secret doubles as the value of the authorization header; keep it out of the logs.
+	logging.RegisterSecret(sharedSecret)
+
+	// Build the settings that can be changed while running: retry policy, heartbeat and device patterns.
+	settings, e := liveSettings(options)
+
+	if e != nil {
+		logger.Errorf("invalid settings: %s", e.Error())
+		return defs.ExitCodeStartupFailure, nil
+	}
+
+	// Open the outbox that feedback will be queued in while waiting to be delivered to the api.
+	outbox, e := beacon.NewFeedbackOutbox(options.outboxDir, options.outboxSize, options.outboxPolicy)
+
+	if e != nil {
+		logger.Errorf("unable to open feedback outbox: %s", e.Error())
+		return defs.ExitCodeStartupFailure, nil
 	}
 
 	var device beacon.Commandable
-	// If the user has launched the application with the `-debug` flag, log to stdout rather than the blink1 device.
-	if options.debugging {
+	// If the user has launched the application with the `-dry-run` flag, log to stdout rather than the blink1 device.
+	if options.dryRun {
 		debugLog := logging.New(defs.DebugStateLoggerPrefix, logging.Cyan)
-		device = &beacon.StateLogger{debugLog}
+		device = &beacon.StateLogger{Logger: debugLog}
 		logger.Debugf("shared secret: \n\n%s\n\n", sharedSecret)
 	} else {
 		var e error
-		device, e = blink1.OpenNextDevice()
+		device, e = openDevice(options.deviceIndex)
 
 		if e != nil {
 			logger.Errorf("unable to open blink device: %s", e.Error())
-			return
+			return defs.ExitCodeStartupFailure, nil
 		}
 	}
 
 	defer device.Close()
-	defer device.SetState(blink1.State{})
 
 	logger.Debugf("creating websocket subscriber w/ api: %s", apiHome.String())
 
-	var subscriber beacon.Subscriber = &beacon.WebsocketSubscriber{
+	config := settings
+	config.APIHome = *apiHome
+	config.DeviceName = options.deviceName
+	config.Subscriber = &beacon.WebsocketSubscriber{
 		Config: beacon.WebsocketConfig{
 			APIHome: *apiHome,
 			Secret:  sharedSecret,
 		},
 	}
+	config.Device = device
+	config.Decrypter = key
+	config.Signer = key
+	config.Outbox = outbox
+	config.Store = beacon.NewRegistrationStore(options.stateDir, options.approveKey)
+	config.Verification = beacon.VerificationConfig{
+		LegacyDigests: options.legacyDigests,
+		MaxClockSkew:  time.Duration(options.maxClockSkew) * time.Second,
+	}
+	config.CommandBuffer = options.commandBuffer
+	config.Logger = logger
 
-	// If the user has provided a device name, pre-register the name with our shared secret before continuing.
-	if options.deviceName != "" {
-		e := subscriber.Preregister(options.deviceName)
+	client, e := beacon.NewClient(config)
 
-		if e != nil {
-			logger.Errorf("unable to register name \"%s\" with api: %s", options.deviceName, e.Error())
-			return
-		}
+	if e != nil {
+		logger.Errorf("invalid client configuration: %s", e.Error())
+		return defs.ExitCodeStartupFailure, nil
 	}
 
-	if e := subscriber.Connect(); e != nil {
-		logger.Errorf("unable to open api subscription: %s (%s)", e.Error(), apiHome.String())
-		return
+	// Metrics are served for as long as this client runs; a changed address restarts the client along with them.
+	if options.metricsAddress != "" {
+		server := serveMetrics(logger, options.metricsAddress)
+		defer server.Close()
 	}
 
-	defer subscriber.Close()
+	// The config file watcher follows -watch-config, which can be turned on and off by reloads.
+	stopWatching := watchConfig(ctx, options, reloads)
+	defer func() { stopWatching() }()
 
-	commandStream := make(chan *bytes.Buffer, options.commandBuffer)
-	feedbackStream := make(chan *beacon.Feedback, options.commandBuffer)
+	stopped := make(chan error, 1)
 
-	bgSync := sync.WaitGroup{}
-	delay, retries := time.Duration(int64(options.heartbeatDelay)*time.Second.Nanoseconds()), 0
+	go func() {
+		stopped <- client.Run(ctx)
+	}()
 
-	processors := []beacon.Processor{
-		beacon.NewCommandProcessor(device, key, commandStream, feedbackStream),
-		beacon.NewHeartbeatProcessor(subscriber, delay, uint(options.maxRetries)),
-		beacon.NewFeedbackProcessor(feedbackStream, *apiHome),
-	}
+	for {
+		select {
+		case e := <-stopped:
+			return exitCode(logger, e), nil
+		case <-reloads:
+			next := reloadOptions(logger)
 
-	// Iterate over each background processor, spawining each in a goroutine with a sync.WaitGroup.
-	for _, p := range processors {
-		bgSync.Add(1)
-		go p.Start(&bgSync)
-	}
+			if next == nil {
+				continue
+			}
 
-	for subscriber.Connected() || retries < options.maxRetries {
-		var e error
+			restart := requiresRestart(options, next)
+
+			if restart != true {
+				current, e := keyState(next.privateKeyfile)
+
+				if e != nil {
+					logger.Warnf("unable to check the device key, keeping the loaded one: %s", e.Error())
+				}
 
-		if subscriber.Connected() {
-			buffer := bytes.NewBuffer([]byte{})
-			e = subscriber.ReadInto(buffer)
+				if e == nil && current != loadedKey {
+					logger.Infof("device key has changed")
+					restart = true
+				}
+			}
+
+			// Logging is opened before anything changes, so a configuration whose logging can't be used is ignored.
+			setup, e := openLogging(next)
+
+			if e == nil && restart != true {
+				if settings, e = liveSettings(next); e == nil {
+					e = client.Update(settings)
+				}
+
+				if e != nil {
+					setup.discard()
+				}
+			}
 
-			// If there was no error, reset our retry counter, send the buffer into our stream and continue on.
-			if e == nil {
-				retries = 0
-				commandStream <- buffer
+			if e != nil {
+				logger.Errorf("unable to apply configuration: %s", e.Error())
 				continue
 			}
-		}
 
-		// If there was an error and we have reached our total count, break from the loop and log the error.
-		if e != nil && retries+1 == options.maxRetries {
-			logger.Errorf("max tries reached & bad read: %s", e.Error())
-			break
-		}
+			setup.apply()
 
-		if e != nil {
-			// At this point, have received an error but we are able to continue on.
-			logger.Warnf("bad read: %s, retrying after %d seconds", e.Error(), 5)
+			if restart {
+				client.Shutdown()
+				<-stopped
+				return defs.ExitCodeSuccess, next
+			}
+
+			if next.watchConfig != options.watchConfig {
+				stopWatching()
+				stopWatching = watchConfig(ctx, next, reloads)
+			}
+
+			options = next
+			logger.Infof("applied new configuration")
 		}
+	}
+}
 
-		// Bump our retry count.
-		retries++
+// openDevice opens the blink1 at the index, counting devices in the order they are enumerated. The library only hands
+// out the next available device, so every device ahead of the selected one is opened along the way and closed again.
+func openDevice(index int) (*blink1.Device, error) {
+	skipped := make([]*blink1.Device, 0, index)
 
-		// Wait the specified amount of seconds.
-		time.Sleep(time.Duration(time.Second.Nanoseconds() * int64(options.retryDelay)))
+	defer func() {
+		for _, device := range skipped {
+			device.Close()
+		}
+	}()
 
-		logger.Infof("attempting retry: %d", retries)
+	for {
+		device, e := blink1.OpenNextDevice()
 
-		// If a device name was provided at startup, we need to pre-register again.
-		if options.deviceName != "" {
-			e := subscriber.Preregister(options.deviceName)
+		if e != nil {
+			return nil, fmt.Errorf("device-not-found: index %d (%d available): %s", index, len(skipped), e.Error())
+		}
 
-			// If we are unable to re-preregister (e.g the server is still down) continue on.
-			if e != nil {
-				logger.Warnf("failed preregister \"%s\" on retry: %s", options.deviceName, e.Error())
-			}
+		if len(skipped) == index {
+			return device, nil
 		}
 
-		// Retry our connection attempt at this point.
-		subscriber.Connect()
+		skipped = append(skipped, device)
+	}
+}
+
+// exitCode logs the reason the client stopped and returns the matching status code.
+func exitCode(logger logging.Logger, e error) int {
+	if e == beacon.ErrReconnectExhausted {
+		logger.Errorf("connection loop terminated: %s", e.Error())
+		return defs.ExitCodeConnectionLost
 	}
 
-	// Close the command stream, terminating the command processor.
-	close(commandStream)
-	close(feedbackStream)
+	if e != nil {
+		logger.Errorf("connection loop terminated: %s", e.Error())
+		return defs.ExitCodeStartupFailure
+	}
 
-	// Wait for all background processors to complete.
-	bgSync.Wait()
-	logger.Warnf("connection loop terminated afte %d retries", retries)
+	logger.Infof("shut down cleanly")
+	return defs.ExitCodeSuccess
 }
@@ -0,0 +1,23 @@
+package main
+
+import "net/http"
+
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/metrics"
+
+// serveMetrics starts listening for prometheus scrapes on the address, returning the server so that it can be closed.
+func serveMetrics(logger logging.Logger, address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(defs.MetricsPath, metrics.Handler())
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		if e := server.ListenAndServe(); e != nil && e != http.ErrServerClosed {
+			logger.Errorf("unable to serve metrics on %s: %s", address, e.Error())
+		}
+	}()
+
+	logger.Infof("serving metrics on %s%s", address, defs.MetricsPath)
+	return server
+}
@@ -0,0 +1,152 @@
+package main
+
+import "os"
+import "flag"
+import "time"
+import "context"
+import "strings"
+import "io/ioutil"
+import "crypto/sha256"
+import "encoding/hex"
+
+import "github.com/dadleyy/beacon.client/beacon"
+import "github.com/dadleyy/beacon.client/beacon/defs"
+import "github.com/dadleyy/beacon.client/beacon/logging"
+import "github.com/dadleyy/beacon.client/beacon/security"
+
+// liveSettings builds the part of the client configuration that can be changed while the client is running.
+func liveSettings(options *clientOptions) (beacon.ClientConfig, error) {
+	disconnected, e := beacon.NewPattern(options.disconnected, options.disconnectRGB)
+
+	if e != nil {
+		return beacon.ClientConfig{}, e
+	}
+
+	shutdownState, e := beacon.ParseColor(options.shutdownColor)
+
+	if e != nil {
+		return beacon.ClientConfig{}, e
+	}
+
+	return beacon.ClientConfig{
+		Reconnect: beacon.ReconnectPolicy{
+			Backoff: beacon.Backoff{
+				Initial: time.Duration(options.retryDelay) * time.Second,
+				Max:     time.Duration(options.maxRetryDelay) * time.Second,
+				Jitter:  options.retryJitter,
+			},
+			MaxRetries: uint(options.maxRetries),
+		},
+		Disconnected:    disconnected,
+		HeartbeatDelay:  time.Duration(options.heartbeatDelay) * time.Second,
+		ShutdownState:   shutdownState,
+		ShutdownTimeout: time.Duration(options.shutdownTimeout) * time.Second,
+	}, nil
+}
+
+// requiresRestart returns true if the options differ in anything other than the settings that can be applied to a
+// running client (e.g the api, key or device). A key replaced without changing its location is caught by keyState.
+func requiresRestart(current *clientOptions, next *clientOptions) bool {
+	live := *next
+	live.heartbeatDelay = current.heartbeatDelay
+	live.retryDelay = current.retryDelay
+	live.maxRetryDelay = current.maxRetryDelay
+	live.retryJitter = current.retryJitter
+	live.maxRetries = current.maxRetries
+	live.disconnected = current.disconnected
+	live.disconnectRGB = current.disconnectRGB
+	live.shutdownColor = current.shutdownColor
+	live.shutdownTimeout = current.shutdownTimeout
+	live.watchConfig = current.watchConfig
+	live.logFormat = current.logFormat
+	live.logOutput = current.logOutput
+	live.logLevel = current.logLevel
+	live.componentLevels = current.componentLevels
+	live.logFile = current.logFile
+	live.logMaxSize = current.logMaxSize
+	live.logMaxAge = current.logMaxAge
+	live.logMaxBackups = current.logMaxBackups
+	live.logCompress = current.logCompress
+	live.unsafeLogging = current.unsafeLogging
+	return live != *current
+}
+
+// reloadOptions loads the options again from the command line, environment and config file, returning nil (after
+// logging every problem) if the result is not valid.
+func reloadOptions(logger logging.Logger) *clientOptions {
+	options := &clientOptions{}
+	flags := newClientFlags(os.Args[0], flag.ContinueOnError, options)
+	problems := append(loadClientOptions(flags, options, os.Args[1:]), options.validate()...)
+
+	if len(problems) == 0 {
+		return options
+	}
+
+	for _, problem := range problems {
+		logger.Errorf("%s", problem.Error())
+	}
+
+	logger.Warnf("keeping the current configuration, new one has %d problem(s)", len(problems))
+	return nil
+}
+
+// keyState identifies the contents of the device key file, so that a reload notices a key that was replaced in place
+// (e.g by rotate-key). Keys on a token are identified by their uri alone.
+func keyState(location string) (string, error) {
+	if strings.HasPrefix(location, security.TokenKeyScheme) {
+		return location, nil
+	}
+
+	data, e := ioutil.ReadFile(location)
+
+	if e != nil {
+		return "", e
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// watchConfig starts watching the config file if the options ask for it, returning the function that stops watching.
+func watchConfig(ctx context.Context, options *clientOptions, reloads chan<- struct{}) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+
+	if options.watchConfig && options.configFile != "" {
+		go watchConfigFile(ctx, options.configFile, reloads)
+	}
+
+	return cancel
+}
+
+// watchConfigFile requests a reload whenever the modification time or size of the file changes.
+func watchConfigFile(ctx context.Context, filename string, reloads chan<- struct{}) {
+	ticker := time.NewTicker(defs.ConfigWatchInterval)
+	defer ticker.Stop()
+
+	last, _ := os.Stat(filename)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, e := os.Stat(filename)
+
+		if e != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+			continue
+		}
+
+		last = info
+		requestReload(reloads)
+	}
+}
+
+// requestReload queues a reload unless one is already pending.
+func requestReload(reloads chan<- struct{}) {
+	select {
+	case reloads <- struct{}{}:
+	default:
+	}
+}
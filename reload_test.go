@@ -0,0 +1,82 @@
+package main
+
+import "reflect"
+import "testing"
+
+func TestRequiresRestart(t *testing.T) {
+	scenarios := []struct {
+		field   string
+		restart bool
+		change  func(*clientOptions)
+	}{
+		{"configFile", true, func(options *clientOptions) { options.configFile = "other.yaml" }},
+		{"watchConfig", false, func(options *clientOptions) { options.watchConfig = true }},
+		{"apiHome", true, func(options *clientOptions) { options.apiHome = "http://other:8080" }},
+		{"dryRun", true, func(options *clientOptions) { options.dryRun = true }},
+		{"deviceIndex", true, func(options *clientOptions) { options.deviceIndex = 1 }},
+		{"commandBuffer", true, func(options *clientOptions) { options.commandBuffer = 8 }},
+		{"heartbeatDelay", false, func(options *clientOptions) { options.heartbeatDelay = 20 }},
+		{"privateKeyfile", true, func(options *clientOptions) { options.privateKeyfile = "other.pem" }},
+		{"deviceName", true, func(options *clientOptions) { options.deviceName = "lobby" }},
+		{"maxRetries", false, func(options *clientOptions) { options.maxRetries = 0 }},
+		{"retryDelay", false, func(options *clientOptions) { options.retryDelay = 1 }},
+		{"maxRetryDelay", false, func(options *clientOptions) { options.maxRetryDelay = 60 }},
+		{"retryJitter", false, func(options *clientOptions) { options.retryJitter = 0.1 }},
+		{"disconnected", false, func(options *clientOptions) { options.disconnected = "solid" }},
+		{"disconnectRGB", false, func(options *clientOptions) { options.disconnectRGB = "00ff00" }},
+		{"outboxDir", true, func(options *clientOptions) { options.outboxDir = "other" }},
+		{"outboxSize", true, func(options *clientOptions) { options.outboxSize = 5 }},
+		{"outboxPolicy", true, func(options *clientOptions) { options.outboxPolicy = "drop-newest" }},
+		{"legacyDigests", true, func(options *clientOptions) { options.legacyDigests = true }},
+		{"maxClockSkew", true, func(options *clientOptions) { options.maxClockSkew = 60 }},
+		{"passphraseFile", true, func(options *clientOptions) { options.passphraseFile = "passphrase" }},
+		{"stateDir", true, func(options *clientOptions) { options.stateDir = "other" }},
+		{"approveKey", true, func(options *clientOptions) { options.approveKey = "fingerprint" }},
+		{"shutdownColor", false, func(options *clientOptions) { options.shutdownColor = "ffffff" }},
+		{"shutdownTimeout", false, func(options *clientOptions) { options.shutdownTimeout = 1 }},
+		{"logFormat", false, func(options *clientOptions) { options.logFormat = "json" }},
+		{"logOutput", false, func(options *clientOptions) { options.logOutput = "file" }},
+		{"logLevel", false, func(options *clientOptions) { options.logLevel = "debug" }},
+		{"componentLevels", false, func(options *clientOptions) { options.componentLevels = "state-logger=warn" }},
+		{"logFile", false, func(options *clientOptions) { options.logFile = "other.log" }},
+		{"logMaxSize", false, func(options *clientOptions) { options.logMaxSize = 1 }},
+		{"logMaxAge", false, func(options *clientOptions) { options.logMaxAge = 1 }},
+		{"logMaxBackups", false, func(options *clientOptions) { options.logMaxBackups = 1 }},
+		{"logCompress", false, func(options *clientOptions) { options.logCompress = false }},
+		{"unsafeLogging", false, func(options *clientOptions) { options.unsafeLogging = true }},
+		{"metricsAddress", true, func(options *clientOptions) { options.metricsAddress = ":9100" }},
+	}
+
+	current, _ := loadOptions()
+	covered := make(map[string]bool)
+
+	if requiresRestart(current, current) {
+		t.Fatalf("expected identical options to not require a restart")
+	}
+
+	for _, scenario := range scenarios {
+		covered[scenario.field] = true
+
+		t.Run(scenario.field, func(t *testing.T) {
+			next := *current
+			scenario.change(&next)
+
+			if next == *current {
+				t.Fatalf("the scenario does not change %s", scenario.field)
+			}
+
+			if restart := requiresRestart(current, &next); restart != scenario.restart {
+				t.Fatalf("expected a change to %s to require a restart: %v, got %v", scenario.field, scenario.restart, restart)
+			}
+		})
+	}
+
+	// Every option has to be classified, so that adding one without deciding whether it is live fails here.
+	fields := reflect.TypeOf(clientOptions{})
+
+	for i := 0; i < fields.NumField(); i++ {
+		if name := fields.Field(i).Name; covered[name] != true {
+			t.Errorf("%s is not covered", name)
+		}
+	}
+}